@@ -0,0 +1,79 @@
+package freezer
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/uw-labs/straw"
+)
+
+// Checkpoint is the position of a consumer within a stream. It identifies the
+// next message to be consumed: the batch sequence number and the number of
+// messages within that batch that have already been consumed.
+type Checkpoint struct {
+	Sequence int `json:"sequence"`
+	Index    int `json:"index"`
+}
+
+const checkpointDir = ".checkpoints"
+
+func checkpointPath(basepath, consumerID string) string {
+	return filepath.Join(basepath, checkpointDir, consumerID)
+}
+
+// ReadCheckpoint returns the stored checkpoint of the named consumer of the
+// stream at path. If the consumer has not stored a checkpoint yet, the
+// returned error satisfies os.IsNotExist.
+func ReadCheckpoint(streamstore straw.StreamStore, path string, consumerID string) (Checkpoint, error) {
+	var cp Checkpoint
+	if err := validConsumerID(consumerID); err != nil {
+		return cp, err
+	}
+	rc, err := streamstore.OpenReadCloser(checkpointPath(path, consumerID))
+	if err != nil {
+		return cp, err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return cp, err
+	}
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return cp, err
+	}
+	return cp, nil
+}
+
+func writeCheckpoint(streamstore straw.StreamStore, path string, consumerID string, cp Checkpoint) error {
+	if err := validConsumerID(consumerID); err != nil {
+		return err
+	}
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	name := checkpointPath(path, consumerID)
+	if err := straw.MkdirAll(streamstore, filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	wc, err := streamstore.CreateWriteCloser(name)
+	if err != nil {
+		return err
+	}
+	if _, err := wc.Write(data); err != nil {
+		_ = wc.Close()
+		return err
+	}
+	return wc.Close()
+}
+
+func validConsumerID(consumerID string) error {
+	if consumerID == "" || strings.ContainsRune(consumerID, filepath.Separator) || strings.HasPrefix(consumerID, ".") {
+		return errors.New("invalid consumer ID")
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package freezer
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+)
+
+func TestCheckpointResume(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	_, err := ReadCheckpoint(ss, "/foo", "consumer")
+	assert.True(os.IsNotExist(err))
+
+	sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo"})
+	require.NoError(err)
+	for b := byte(0); b < 2; b++ {
+		assert.NoError(sink.PutMessage([]byte{b, 0}))
+		assert.NoError(sink.PutMessage([]byte{b, 1}))
+		assert.NoError(sink.Flush())
+	}
+	assert.NoError(sink.Close())
+
+	consume := func(n int) [][]byte {
+		source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", PollPeriod: 10 * time.Millisecond, ConsumerID: "consumer"})
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*1)
+		defer cancel()
+
+		var got [][]byte
+		assert.NoError(source.ConsumeMessages(ctx, func(m []byte) error {
+			got = append(got, m)
+			if len(got) == n {
+				cancel()
+			}
+			return nil
+		}))
+		return got
+	}
+
+	assert.Equal([][]byte{{0, 0}, {0, 1}, {1, 0}}, consume(3))
+
+	cp, err := ReadCheckpoint(ss, "/foo", "consumer")
+	require.NoError(err)
+	assert.Equal(Checkpoint{Sequence: 1, Index: 1}, cp)
+
+	assert.Equal([][]byte{{1, 1}}, consume(1))
+
+	cp, err = ReadCheckpoint(ss, "/foo", "consumer")
+	require.NoError(err)
+	assert.Equal(Checkpoint{Sequence: 2, Index: 0}, cp)
+
+	next, err := nextSequence(ss, "/foo")
+	assert.NoError(err)
+	assert.Equal(2, next)
+}
@@ -1,7 +1,13 @@
 package freezer
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/uw-labs/straw"
@@ -15,12 +21,303 @@ const (
 	CompressionTypeZstd   CompressionType = 2
 )
 
-func newSnappyStreamStore(store straw.StreamStore) *snappyStreamStore {
-	return &snappyStreamStore{store}
+// Codec compresses and decompresses batch files. Codecs other than snappy and
+// zstd can be added with RegisterCodec.
+type Codec interface {
+	// NewReader returns a reader that decompresses data read from r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+	// NewWriter returns a writer that compresses data written to it to w.
+	// Closing it must flush all data to w, but not close w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
 }
 
-func newZstdStreamStore(store straw.StreamStore) *zstdStreamStore {
-	return &zstdStreamStore{store}
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[CompressionType]Codec{}
+)
+
+// RegisterCodec makes a codec available as the given compression type, for
+// use by sinks and sources. The compression type is recorded in the header of
+// batch files, so must be between 64 and 255, as types below 64 are reserved
+// for freezer, and the same codec must be registered as it wherever the stream
+// is read. RegisterCodec panics if the type is invalid or already registered.
+func RegisterCodec(ct CompressionType, c Codec) {
+	if ct < 0 || ct > 255 {
+		panic(fmt.Sprintf("freezer: invalid compression type %d", ct))
+	}
+	if ct < 64 {
+		panic(fmt.Sprintf("freezer: compression type %d is reserved", ct))
+	}
+	registerCodec(ct, c)
+}
+
+func registerCodec(ct CompressionType, c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if _, ok := codecs[ct]; ok {
+		panic(fmt.Sprintf("freezer: compression type %d registered twice", ct))
+	}
+	codecs[ct] = c
+}
+
+func codecFor(ct CompressionType) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[ct]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression type %d", ct)
+	}
+	return c, nil
+}
+
+func newDecompressor(ct CompressionType, r io.Reader) (io.ReadCloser, error) {
+	c, err := codecFor(ct)
+	if err != nil {
+		return nil, err
+	}
+	return c.NewReader(r)
+}
+
+func newCompressor(ct CompressionType, w io.Writer) (io.WriteCloser, error) {
+	c, err := codecFor(ct)
+	if err != nil {
+		return nil, err
+	}
+	return c.NewWriter(w)
+}
+
+func init() {
+	registerCodec(CompressionTypeNone, noneCodec{})
+}
+
+// noneCodec leaves data uncompressed.
+type noneCodec struct{}
+
+func (noneCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil
+}
+
+func (noneCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+var _ straw.StreamStore = &compressionStreamStore{}
+
+// compressionStreamStore is a straw.StreamStore wrapper that implements transparent compression. Files are written using compressionType, preceded by a header naming it if writeHeader is set. Files are read using the compression type named by their header, or compressionType if they have none. Everything is supported, except for calling Size() on the os.FileInfo returned from Stat or Lstat.  Calling Size() like this will panic, but freezer does not need that functionality anyway.
+type compressionStreamStore struct {
+	store           straw.StreamStore
+	path            string
+	compressionType CompressionType
+	writeHeader     bool
+
+	// codec, if set, is used to write files in place of the codec
+	// registered as compressionType.
+	codec Codec
+	// dictID, if set, is the ID of the zstd dictionary used by codec.
+	dictID uint32
+
+	// dicts caches the zstd dictionaries loaded from the stream at path.
+	dictsMu sync.Mutex
+	dicts   map[uint32][]byte
+}
+
+// newCompressionStreamStore returns a compressionStreamStore for the stream at
+// path, which is where zstd dictionaries are loaded from.
+func newCompressionStreamStore(store straw.StreamStore, path string, ct CompressionType, writeHeader bool) *compressionStreamStore {
+	return &compressionStreamStore{store: store, path: path, compressionType: ct, writeHeader: writeHeader}
+}
+
+func (fs *compressionStreamStore) Lstat(name string) (os.FileInfo, error) {
+	fi, err := fs.store.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &noSizeFileInfo{fi}, nil
+}
+
+func (fs *compressionStreamStore) Stat(name string) (os.FileInfo, error) {
+	fi, err := fs.store.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &noSizeFileInfo{fi}, nil
+}
+
+func (fs *compressionStreamStore) OpenReadCloser(name string) (straw.StrawReader, error) {
+	rc, err := fs.store.OpenReadCloser(name)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(rc)
+	h, ok, err := readHeader(br)
+	if isIncomplete(err) {
+		return &incompleteReadCloser{rc, err}, nil
+	}
+	if err != nil {
+		_ = rc.Close()
+		return nil, fmt.Errorf("could not read header of %v (%v)", name, err)
+	}
+	if !ok {
+		h.compressionType = fs.compressionType
+	}
+
+	var r io.ReadCloser
+	if h.dictID != 0 {
+		r, err = fs.newDictDecompressor(h, br)
+	} else {
+		r, err = newDecompressor(h.compressionType, br)
+	}
+	if err != nil {
+		_ = rc.Close()
+		return nil, err
+	}
+	return &compressedReadCloser{&decompressor{r}, rc}, nil
+}
+
+func (fs *compressionStreamStore) Mkdir(name string, mode os.FileMode) error {
+	return fs.store.Mkdir(name, mode)
+}
+
+func (fs *compressionStreamStore) Remove(name string) error {
+	return fs.store.Remove(name)
+}
+
+func (fs *compressionStreamStore) CreateWriteCloser(name string) (straw.StrawWriter, error) {
+	wc, err := fs.store.CreateWriteCloser(name)
+	if err != nil {
+		return nil, err
+	}
+	cw := &countingWriter{w: wc}
+	if fs.writeHeader || fs.dictID != 0 {
+		if err := writeHeader(cw, fileHeader{fs.compressionType, fs.dictID}); err != nil {
+			_ = wc.Close()
+			return nil, err
+		}
+	}
+	var w io.WriteCloser
+	if fs.codec != nil {
+		w, err = fs.codec.NewWriter(cw)
+	} else {
+		w, err = newCompressor(fs.compressionType, cw)
+	}
+	if err != nil {
+		_ = wc.Close()
+		return nil, err
+	}
+	return &compressedWriteCloser{w, wc, cw}, nil
+}
+
+func (fs *compressionStreamStore) Readdir(name string) ([]os.FileInfo, error) {
+	return fs.store.Readdir(name)
+}
+
+func (fs *compressionStreamStore) Close() error {
+	return fs.store.Close()
+}
+
+// decompressor marks the errors returned by a decompressing reader, other than
+// io.EOF, as decompression errors.
+type decompressor struct {
+	io.ReadCloser
+}
+
+func (d *decompressor) Read(buf []byte) (int, error) {
+	n, err := d.ReadCloser.Read(buf)
+	if err != nil && err != io.EOF {
+		err = &decompressionError{err}
+	}
+	return n, err
+}
+
+// decompressionError is returned when a batch could not be decompressed. Some
+// codecs report data that ends part way through a compressed block as corrupt,
+// so a batch that is still being written may fail with it.
+type decompressionError struct {
+	err error
+}
+
+func (e *decompressionError) Error() string {
+	return e.err.Error()
+}
+
+func (e *decompressionError) Unwrap() error {
+	return e.err
+}
+
+func isDecompressionError(err error) bool {
+	var de *decompressionError
+	return errors.As(err, &de)
+}
+
+type compressedReadCloser struct {
+	sr    io.ReadCloser
+	inner io.Closer
+}
+
+func (src *compressedReadCloser) Read(buf []byte) (int, error) {
+	return src.sr.Read(buf)
+}
+
+func (src *compressedReadCloser) Close() error {
+	_ = src.sr.Close()
+	return src.inner.Close()
+}
+
+func (src *compressedReadCloser) Seek(int64, int) (int64, error) {
+	panic("freezer: Seek not supported in compressed read closer")
+}
+
+func (src *compressedReadCloser) ReadAt([]byte, int64) (int, error) {
+	panic("freezer: ReadAt not supported in compressed read closer")
+}
+
+type compressedWriteCloser struct {
+	swc     io.WriteCloser
+	inner   io.Closer
+	counter *countingWriter
+}
+
+func (src *compressedWriteCloser) Write(buf []byte) (int, error) {
+	return src.swc.Write(buf)
+}
+
+func (src *compressedWriteCloser) Close() error {
+	if err := src.swc.Close(); err != nil {
+		_ = src.inner.Close()
+		return err
+	}
+	return src.inner.Close()
+}
+
+// storedBytes returns the number of bytes written to the underlying store by a
+// writer from a compressionStreamStore.
+func storedBytes(w io.Writer) int64 {
+	if cwc, ok := w.(*compressedWriteCloser); ok {
+		return atomic.LoadInt64(&cwc.counter.n)
+	}
+	return 0
+}
+
+// countingWriter counts the bytes written to the wrapped writer. Some
+// compressors write from other goroutines, so n must be accessed atomically.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(buf []byte) (int, error) {
+	n, err := cw.w.Write(buf)
+	atomic.AddInt64(&cw.n, int64(n))
+	return n, err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
 }
 
 // noSizeFileInfo wraps another os.FileInfo but will panic if Size() is called.
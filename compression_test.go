@@ -0,0 +1,96 @@
+package freezer
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+)
+
+const compressionTypeTestGzip CompressionType = 64
+
+func init() {
+	RegisterCodec(compressionTypeTestGzip, gzipCodec{})
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func TestRegisteredCodec(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo", CompressionType: compressionTypeTestGzip, WriteHeader: true})
+	require.NoError(err)
+	assert.NoError(sink.PutMessage([]byte("hello")))
+	assert.NoError(sink.Close())
+
+	// the source finds the codec from the header.
+	source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", StopAtEnd: true})
+
+	got, err := consumeAll(context.Background(), source)
+	assert.NoError(err)
+	assert.Equal([][]byte{[]byte("hello")}, got)
+}
+
+func TestRegisterCodecInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.PanicsWithValue("freezer: compression type 1 is reserved", func() { RegisterCodec(CompressionTypeSnappy, gzipCodec{}) })
+	assert.PanicsWithValue("freezer: compression type 63 is reserved", func() { RegisterCodec(63, gzipCodec{}) })
+	assert.PanicsWithValue("freezer: compression type 64 registered twice", func() { RegisterCodec(compressionTypeTestGzip, gzipCodec{}) })
+	assert.PanicsWithValue("freezer: invalid compression type 256", func() { RegisterCodec(256, gzipCodec{}) })
+}
+
+func TestUnknownCodec(t *testing.T) {
+	assert := assert.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	_, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo", CompressionType: 200})
+	assert.EqualError(err, "unknown compression type 200")
+
+	source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", CompressionType: 200})
+	_, err = source.NewReader()
+	assert.EqualError(err, "unknown compression type 200")
+	assert.EqualError(source.ConsumeMessages(context.Background(), func([]byte) error { return nil }), "unknown compression type 200")
+}
+
+func TestZstdOptions(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	_, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo", CompressionType: CompressionTypeZstd, Zstd: ZstdOptions{WindowSize: 1000}})
+	assert.EqualError(err, "window size must be at least 1024")
+
+	for i, options := range []ZstdOptions{
+		{Level: 1},
+		{Level: 19, WindowSize: 1 << 16, Concurrency: 1, DisableCRC: true},
+	} {
+		sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo", CompressionType: CompressionTypeZstd, Zstd: options})
+		require.NoError(err)
+		assert.NoError(sink.PutMessage([]byte{byte(i)}))
+		assert.NoError(sink.Close())
+	}
+
+	source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", CompressionType: CompressionTypeZstd, StopAtEnd: true})
+
+	got, err := consumeAll(context.Background(), source)
+	assert.NoError(err)
+	assert.Equal([][]byte{{0}, {1}}, got)
+}
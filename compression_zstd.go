@@ -2,114 +2,97 @@ package freezer
 
 import (
 	"io"
-	"os"
 
 	"github.com/klauspost/compress/zstd"
-	"github.com/uw-labs/straw"
 )
 
-var _ straw.StreamStore = &zstdStreamStore{}
-
-// zstdStreamStore is a straw.StreamStore wrapper that implements transparent zstd compression. Everything is supported, except for calling Size() on the os.FileInfo returned from Stat or Lstat.  Calling Size() like this will panic, but freezer does not need that functionality anyway.
-type zstdStreamStore struct {
-	store straw.StreamStore
-}
-
-func (fs *zstdStreamStore) Lstat(name string) (os.FileInfo, error) {
-	fi, err := fs.store.Lstat(name)
-	if err != nil {
-		return nil, err
+func init() {
+	registerCodec(CompressionTypeZstd, zstdCodec{})
+}
+
+// ZstdOptions tunes the zstd compression of batches written by a sink. Zero
+// values leave the defaults of the zstd encoder in place. The options do not
+// affect reading.
+type ZstdOptions struct {
+	// Level is the compression level, from 1 to 22 as for the zstd command
+	// line tool. It is mapped to the nearest of the encoder's own levels by
+	// zstd.EncoderLevelFromZstd.
+	Level int
+	// WindowSize is how far back, in bytes, the encoder looks for matches.
+	// It must be a power of two of at least 1KiB. Larger windows give
+	// better compression, but take more memory to write and read.
+	WindowSize int
+	// Concurrency is the number of goroutines used to compress each batch.
+	Concurrency int
+	// DisableCRC leaves the checksum out of compressed data.
+	DisableCRC bool
+}
+
+// level returns the encoder level for Level, or zero if it is not set.
+func (o ZstdOptions) level() zstd.EncoderLevel {
+	if o.Level <= 0 {
+		return 0
 	}
-	return &noSizeFileInfo{fi}, nil
+	return zstd.EncoderLevelFromZstd(o.Level)
 }
 
-func (fs *zstdStreamStore) Stat(name string) (os.FileInfo, error) {
-	fi, err := fs.store.Stat(name)
-	if err != nil {
-		return nil, err
+func (o ZstdOptions) encoderOptions() []zstd.EOption {
+	var opts []zstd.EOption
+	if l := o.level(); l != 0 {
+		opts = append(opts, zstd.WithEncoderLevel(l))
+	}
+	if o.WindowSize != 0 {
+		opts = append(opts, zstd.WithWindowSize(o.WindowSize))
+	}
+	if o.Concurrency != 0 {
+		opts = append(opts, zstd.WithEncoderConcurrency(o.Concurrency))
 	}
-	return &noSizeFileInfo{fi}, nil
+	if o.DisableCRC {
+		opts = append(opts, zstd.WithEncoderCRC(false))
+	}
+	return opts
 }
 
-func (fs *zstdStreamStore) OpenReadCloser(name string) (straw.StrawReader, error) {
-	rc, err := fs.store.OpenReadCloser(name)
+// newZstdCodec returns a zstd codec that writes with the given options and
+// dictionary, if any, or an error if they are invalid.
+func newZstdCodec(o ZstdOptions, dictID uint32, dict []byte) (Codec, error) {
+	c := zstdCodec{o, dictID, dict}
+	e, err := zstd.NewWriter(nil, c.encoderOptions()...)
 	if err != nil {
 		return nil, err
 	}
-
-	r, err := zstd.NewReader(rc)
-	if err != nil {
-		_ = rc.Close()
+	if err := e.Close(); err != nil {
 		return nil, err
 	}
-	return &zstdReadCloser{r, rc}, nil
-
+	return c, nil
 }
 
-func (fs *zstdStreamStore) Mkdir(name string, mode os.FileMode) error {
-	return fs.store.Mkdir(name, mode)
+type zstdCodec struct {
+	options ZstdOptions
+	dictID  uint32
+	dict    []byte
 }
 
-func (fs *zstdStreamStore) Remove(name string) error {
-	return fs.store.Remove(name)
+func (c zstdCodec) encoderOptions() []zstd.EOption {
+	opts := c.options.encoderOptions()
+	switch {
+	case c.dict == nil:
+	case isRawDictionary(c.dict):
+		opts = append(opts, zstd.WithEncoderDictRaw(c.dictID, c.dict))
+	default:
+		opts = append(opts, zstd.WithEncoderDict(c.dict))
+	}
+	return opts
 }
 
-func (fs *zstdStreamStore) CreateWriteCloser(name string) (straw.StrawWriter, error) {
-	wc, err := fs.store.CreateWriteCloser(name)
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r)
 	if err != nil {
 		return nil, err
 	}
-	w, err := zstd.NewWriter(wc)
-	if err != nil {
-		_ = wc.Close()
-		return nil, err
-	}
-	return &zstdWriteCloser{w, wc}, nil
-}
-
-func (fs *zstdStreamStore) Readdir(name string) ([]os.FileInfo, error) {
-	return fs.store.Readdir(name)
-}
-
-func (fs *zstdStreamStore) Close() error {
-	return fs.store.Close()
-}
-
-type zstdReadCloser struct {
-	sr    *zstd.Decoder
-	inner io.Closer
-}
-
-func (src *zstdReadCloser) Read(buf []byte) (int, error) {
-	return src.sr.Read(buf)
-}
-
-func (src *zstdReadCloser) Close() error {
-	src.sr.Close()
-	return src.inner.Close()
+	return d.IOReadCloser(), nil
 }
 
-func (src *zstdReadCloser) Seek(int64, int) (int64, error) {
-	panic("freezer: Seek not supported in zstd read closer")
-}
-
-func (src *zstdReadCloser) ReadAt([]byte, int64) (int, error) {
-	panic("freezer: ReadAt not supported in zstd read closer")
-}
-
-type zstdWriteCloser struct {
-	swc   io.WriteCloser
-	inner io.Closer
-}
-
-func (src *zstdWriteCloser) Write(buf []byte) (int, error) {
-	return src.swc.Write(buf)
-}
-
-func (src *zstdWriteCloser) Close() error {
-	if err := src.swc.Close(); err != nil {
-		_ = src.inner.Close()
-		return err
-	}
-	return src.inner.Close()
+func (c zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, c.encoderOptions()...)
 }
@@ -0,0 +1,177 @@
+package freezer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/uw-labs/straw"
+)
+
+// zstd dictionaries are stored in the stream directory, named by their ID, and
+// never change once written. Batch files name the dictionary they were
+// compressed with in their header.
+
+const dictDir = ".dictionaries"
+
+// maxDictSize is the largest amount of sample data a dictionary is built from.
+const maxDictSize = 64 << 10
+
+func dictPath(basepath string, id uint32) string {
+	return filepath.Join(basepath, dictDir, strconv.FormatUint(uint64(id), 10))
+}
+
+// dictionaryID derives a dictionary ID from the samples it is trained on, so
+// that sinks given the same samples share a dictionary. IDs are kept out of
+// the ranges that the zstd format reserves.
+func dictionaryID(samples [][]byte) uint32 {
+	h := sha256.New()
+	var l [4]byte
+	for _, s := range samples {
+		binary.LittleEndian.PutUint32(l[:], uint32(len(s)))
+		h.Write(l[:])
+		h.Write(s)
+	}
+	sum := h.Sum(nil)
+	return 1<<15 + binary.LittleEndian.Uint32(sum)%(1<<31-1<<15)
+}
+
+// loadOrTrainDictionary returns the dictionary trained on samples, training
+// and storing it in the stream at path if it does not exist yet.
+func loadOrTrainDictionary(ss straw.StreamStore, path string, samples [][]byte, o ZstdOptions) (uint32, []byte, error) {
+	id := dictionaryID(samples)
+	dict, err := readDictionary(ss, path, id)
+	if err == nil {
+		return id, dict, nil
+	}
+	if !os.IsNotExist(err) {
+		return 0, nil, err
+	}
+
+	dict, err = trainDictionary(id, samples, o)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	name := dictPath(path, id)
+	if err := straw.MkdirAll(ss, filepath.Dir(name), 0755); err != nil {
+		return 0, nil, err
+	}
+	wc, err := ss.CreateWriteCloser(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, err := wc.Write(dict); err != nil {
+		_ = wc.Close()
+		return 0, nil, err
+	}
+	if err := wc.Close(); err != nil {
+		return 0, nil, err
+	}
+	return id, dict, nil
+}
+
+// trainDictionary builds a dictionary from samples. If the samples all fit in
+// the dictionary, or the zstd package cannot build entropy tables from them,
+// the dictionary is the raw sample data, which zstd supports as a "raw
+// content" dictionary.
+func trainDictionary(id uint32, samples [][]byte, o ZstdOptions) ([]byte, error) {
+	var history []byte
+	for _, s := range samples {
+		history = append(history, s...)
+	}
+	if len(history) < 8 {
+		return nil, errors.New("not enough zstd dictionary sample data")
+	}
+	if len(history) <= maxDictSize {
+		return history, nil
+	}
+	history = history[len(history)-maxDictSize:]
+	dict, ok, err := buildDict(zstd.BuildDictOptions{
+		ID:       id,
+		Contents: samples,
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+		Level:    o.level(),
+	})
+	if !ok {
+		return history, nil
+	}
+	return dict, err
+}
+
+// buildDict calls zstd.BuildDict, reporting false if it panicked. It panics
+// rather than returning an error when the samples give too few matches to
+// build its tables, as with high entropy samples.
+func buildDict(o zstd.BuildDictOptions) (dict []byte, ok bool, err error) {
+	defer func() {
+		if recover() != nil {
+			dict, ok, err = nil, false, nil
+		}
+	}()
+	dict, err = zstd.BuildDict(o)
+	return dict, true, err
+}
+
+// isRawDictionary reports whether dict is raw content rather than a trained
+// dictionary, which starts with a magic number.
+func isRawDictionary(dict []byte) bool {
+	return !bytes.HasPrefix(dict, []byte{0x37, 0xa4, 0x30, 0xec})
+}
+
+func readDictionary(ss straw.StreamStore, path string, id uint32) ([]byte, error) {
+	rc, err := ss.OpenReadCloser(dictPath(path, id))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// dictionary returns the dictionary with the given ID, loading it from the
+// stream if it has not been loaded already.
+func (fs *compressionStreamStore) dictionary(id uint32) ([]byte, error) {
+	fs.dictsMu.Lock()
+	defer fs.dictsMu.Unlock()
+	if dict, ok := fs.dicts[id]; ok {
+		return dict, nil
+	}
+	dict, err := readDictionary(fs.store, fs.path, id)
+	if err != nil {
+		return nil, fmt.Errorf("could not load zstd dictionary %d (%v)", id, err)
+	}
+	if fs.dicts == nil {
+		fs.dicts = make(map[uint32][]byte)
+	}
+	fs.dicts[id] = dict
+	return dict, nil
+}
+
+// newDictDecompressor returns a reader for a file compressed with the zstd
+// dictionary named by its header.
+func (fs *compressionStreamStore) newDictDecompressor(h fileHeader, br *bufio.Reader) (io.ReadCloser, error) {
+	if h.compressionType != CompressionTypeZstd {
+		return nil, fmt.Errorf("compression type %d does not support dictionaries", h.compressionType)
+	}
+	dict, err := fs.dictionary(h.dictID)
+	if err != nil {
+		return nil, err
+	}
+	opt := zstd.WithDecoderDicts(dict)
+	if isRawDictionary(dict) {
+		opt = zstd.WithDecoderDictRaw(h.dictID, dict)
+	}
+	d, err := zstd.NewReader(br, opt)
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
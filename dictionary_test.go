@@ -0,0 +1,119 @@
+package freezer
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+)
+
+func jsonMessages(n, from int) [][]byte {
+	var ms [][]byte
+	for i := from; i < from+n; i++ {
+		ms = append(ms, []byte(fmt.Sprintf(`{"id":%d,"type":"account_updated","account":{"name":"user%d","status":"active"}}`, i, i)))
+	}
+	return ms
+}
+
+func TestZstdDictionary(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	samples := jsonMessages(100, 0)
+	messages := jsonMessages(20, 1000)
+
+	var sizes []int64
+	for _, config := range []MessageSinkConfig{
+		{Path: "/plain", CompressionType: CompressionTypeZstd},
+		{Path: "/dict", CompressionType: CompressionTypeZstd, ZstdDictionarySamples: samples},
+	} {
+		sink, err := NewMessageSink(ss, config)
+		require.NoError(err)
+		assert.NoError(sink.PutMessages(messages))
+		info, err := sink.FlushBatch()
+		require.NoError(err)
+		sizes = append(sizes, info.StoredBytes)
+		assert.NoError(sink.Close())
+	}
+	assert.Less(sizes[1], sizes[0])
+
+	// a sink given the same samples uses the same dictionary.
+	sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/dict", CompressionType: CompressionTypeZstd, ZstdDictionarySamples: samples})
+	require.NoError(err)
+	assert.NoError(sink.PutMessage([]byte(`{"id":1}`)))
+	assert.NoError(sink.Close())
+
+	fis, err := ss.Readdir(filepath.Join("/dict", dictDir))
+	require.NoError(err)
+	assert.Equal(1, len(fis))
+
+	// the source finds the dictionary from the batch headers.
+	source := NewMessageSource(ss, MessageSourceConfig{Path: "/dict", StopAtEnd: true})
+
+	got, err := consumeAll(context.Background(), source)
+	assert.NoError(err)
+	assert.Equal(append(messages, []byte(`{"id":1}`)), got)
+}
+
+func TestZstdDictionaryRequiresZstd(t *testing.T) {
+	assert := assert.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	_, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo", CompressionType: CompressionTypeSnappy, ZstdDictionarySamples: jsonMessages(10, 0)})
+	assert.EqualError(err, "zstd dictionary samples require zstd compression")
+}
+
+func TestTrainDictionary(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// samples that fit in the dictionary are used as raw content.
+	dict, err := trainDictionary(1<<15, jsonMessages(100, 0), ZstdOptions{})
+	require.NoError(err)
+	assert.True(isRawDictionary(dict))
+
+	dict, err = trainDictionary(1<<15, jsonMessages(1000, 0), ZstdOptions{Level: 1})
+	require.NoError(err)
+	assert.False(isRawDictionary(dict))
+
+	_, err = trainDictionary(1<<15, [][]byte{{1}}, ZstdOptions{})
+	assert.EqualError(err, "not enough zstd dictionary sample data")
+}
+
+func TestZstdDictionaryIncompressibleSamples(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	// random samples give zstd too few matches to train a dictionary from,
+	// so the raw samples are used.
+	rnd := rand.New(rand.NewSource(1))
+	var samples [][]byte
+	for i := 0; i < 600; i++ {
+		s := make([]byte, 200)
+		rnd.Read(s)
+		samples = append(samples, s)
+	}
+
+	sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo", CompressionType: CompressionTypeZstd, Zstd: ZstdOptions{Level: 1}, ZstdDictionarySamples: samples})
+	require.NoError(err)
+	dict, err := readDictionary(ss, "/foo", dictionaryID(samples))
+	require.NoError(err)
+	assert.True(isRawDictionary(dict))
+	assert.NoError(sink.PutMessages(samples[:2]))
+	assert.NoError(sink.Close())
+
+	source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", StopAtEnd: true})
+	got, err := consumeAll(context.Background(), source)
+	assert.NoError(err)
+	assert.Equal(samples[:2], got)
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/uw-labs/straw"
 )
@@ -23,23 +25,23 @@ func seqToPath(basepath string, seq int) string {
 const dirDepth = 6
 
 func nextSequence(ss straw.StreamStore, basedir string) (int, error) {
-	_, err := ss.Stat(seqToPath(basedir, 0))
-	if err != nil {
-		if os.IsNotExist(err) {
-			return 0, nil
-		}
-		return -1, err
-	}
-
 	dir := basedir
 	total := 0
 	for i := 0; i <= dirDepth; i++ {
-		fis, err := ss.Readdir(dir)
+		fis, err := readdirVisible(ss, dir)
 		if err != nil {
+			if i == 0 && os.IsNotExist(err) {
+				return 0, nil
+			}
 			return -1, err
 		}
 		l := len(fis)
 		if l == 0 {
+			// the first batches may have been removed by Retention, so
+			// an empty stream is recognised by having none at all.
+			if i == 0 {
+				return 0, nil
+			}
 			return -1, fmt.Errorf("'%s' does not contain enough folders", basedir)
 		}
 		fi := fis[l-1]
@@ -56,3 +58,23 @@ func nextSequence(ss straw.StreamStore, basedir string) (int, error) {
 	}
 	return total + 1, nil
 }
+
+// readdirVisible lists a directory, omitting entries whose names start with a
+// dot. Such entries hold stream metadata (checkpoints and the like) rather
+// than batches. Entries are sorted by name, which not all stores guarantee.
+func readdirVisible(ss straw.StreamStore, dir string) ([]os.FileInfo, error) {
+	fis, err := ss.Readdir(dir)
+	if err != nil {
+		return nil, err
+	}
+	visible := fis[:0]
+	for _, fi := range fis {
+		if !strings.HasPrefix(fi.Name(), ".") {
+			visible = append(visible, fi)
+		}
+	}
+	sort.Slice(visible, func(i, j int) bool {
+		return visible[i].Name() < visible[j].Name()
+	})
+	return visible, nil
+}
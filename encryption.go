@@ -0,0 +1,419 @@
+package freezer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/uw-labs/straw"
+)
+
+// KeyProvider supplies the master keys used by an encrypting store. Keys are
+// AES keys, so must be 16, 24 or 32 bytes long. Each file records the ID of
+// the key it was encrypted with, so keys can be rotated by changing the
+// current key, as long as older keys remain available by ID.
+type KeyProvider interface {
+	// CurrentKey returns the ID and value of the key to encrypt new files
+	// with.
+	CurrentKey() (string, []byte, error)
+	// Key returns the value of the key with the given ID.
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider holding a fixed set of keys.
+type StaticKeys struct {
+	// CurrentID is the ID of the key to encrypt new files with.
+	CurrentID string
+	// Keys are the available keys, by ID.
+	Keys map[string][]byte
+}
+
+func (k StaticKeys) CurrentKey() (string, []byte, error) {
+	key, err := k.Key(k.CurrentID)
+	return k.CurrentID, key, err
+}
+
+func (k StaticKeys) Key(id string) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", id)
+	}
+	return key, nil
+}
+
+type EncryptionConfig struct {
+	Keys KeyProvider
+
+	// ChunkSize is the amount of data encrypted at a time, up to 16MiB.
+	// Readers only see data written to a file once a whole chunk has been
+	// written. The default is DefaultEncryptionChunkSize.
+	ChunkSize int
+
+	// AllowPlaintext makes files that are not encrypted readable as they
+	// are, so that existing streams can be moved to encryption. Without it,
+	// reading such a file fails with ErrNotEncrypted.
+	AllowPlaintext bool
+}
+
+const (
+	DefaultEncryptionChunkSize = 64 << 10
+	maxEncryptionChunkSize     = 16 << 20
+)
+
+var (
+	// ErrNotEncrypted is returned when reading a file that is not
+	// encrypted from an encrypting store that does not allow plaintext.
+	ErrNotEncrypted = errors.New("file is not encrypted")
+	// ErrDecryptionFailed is returned when an encrypted file has been
+	// altered or truncated, or is not encrypted with the key it names.
+	ErrDecryptionFailed = errors.New("file could not be decrypted")
+)
+
+// errIncomplete is returned when an encrypted file ends before its final
+// chunk. The file may have been truncated, so it fails to decrypt, but it may
+// also still be being written.
+var errIncomplete error = &incompleteError{"encrypted file is incomplete", ErrDecryptionFailed}
+
+// An encrypted file starts with a header, which is the magic bytes, a version
+// byte, the length of the key ID, the key ID, the chunk size as 4 little
+// endian bytes, and the file's data key encrypted with the master key. The
+// data key is random and used for this file only. The rest of the file is the
+// data split into chunks, each encrypted with the data key using AES-GCM.
+// Chunk nonces are a counter and a flag marking the final chunk, which is
+// shorter than the chunk size (and may be empty), so that chunks cannot be
+// reordered. A file without a final chunk, including one truncated at a chunk
+// boundary, fails to decrypt with errIncomplete.
+
+var encryptionMagic = []byte{0x89, 'F', 'R', 'E'}
+
+const (
+	encryptionVersion = 1
+	dataKeyLen        = 32
+)
+
+var _ straw.StreamStore = &encryptingStreamStore{}
+
+// encryptingStreamStore is a straw.StreamStore wrapper that implements
+// transparent encryption. The sizes reported by Stat, Lstat and Readdir are
+// those of the encrypted files.
+type encryptingStreamStore struct {
+	store          straw.StreamStore
+	keys           KeyProvider
+	chunkSize      int
+	allowPlaintext bool
+}
+
+// NewEncryptingStreamStore returns a store that encrypts files written to
+// store, and decrypts files read from it. Sinks and sources can use it in
+// place of store, and compress data before it is encrypted.
+func NewEncryptingStreamStore(store straw.StreamStore, config EncryptionConfig) (straw.StreamStore, error) {
+	fs := &encryptingStreamStore{
+		store:          store,
+		keys:           config.Keys,
+		chunkSize:      config.ChunkSize,
+		allowPlaintext: config.AllowPlaintext,
+	}
+	if fs.keys == nil {
+		return nil, errors.New("no key provider")
+	}
+	if fs.chunkSize == 0 {
+		fs.chunkSize = DefaultEncryptionChunkSize
+	}
+	if fs.chunkSize < 0 || fs.chunkSize > maxEncryptionChunkSize {
+		return nil, fmt.Errorf("invalid chunk size %d", fs.chunkSize)
+	}
+	return fs, nil
+}
+
+func (fs *encryptingStreamStore) Lstat(name string) (os.FileInfo, error) {
+	return fs.store.Lstat(name)
+}
+
+func (fs *encryptingStreamStore) Stat(name string) (os.FileInfo, error) {
+	return fs.store.Stat(name)
+}
+
+func (fs *encryptingStreamStore) Mkdir(name string, mode os.FileMode) error {
+	return fs.store.Mkdir(name, mode)
+}
+
+func (fs *encryptingStreamStore) Remove(name string) error {
+	return fs.store.Remove(name)
+}
+
+func (fs *encryptingStreamStore) Readdir(name string) ([]os.FileInfo, error) {
+	return fs.store.Readdir(name)
+}
+
+func (fs *encryptingStreamStore) Close() error {
+	return fs.store.Close()
+}
+
+func (fs *encryptingStreamStore) CreateWriteCloser(name string) (straw.StrawWriter, error) {
+	keyID, key, err := fs.keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	if len(keyID) > 255 {
+		return nil, fmt.Errorf("key ID %q is too long", keyID)
+	}
+
+	header := append([]byte{}, encryptionMagic...)
+	header = append(header, encryptionVersion, byte(len(keyID)))
+	header = append(header, keyID...)
+	var cs [4]byte
+	binary.LittleEndian.PutUint32(cs[:], uint32(fs.chunkSize))
+	header = append(header, cs[:]...)
+
+	dataKey := make([]byte, dataKeyLen)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	kek, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, kek.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	// the header so far is authenticated along with the data key.
+	wrapped := kek.Seal(nonce, nonce, dataKey, header)
+	header = append(header, wrapped...)
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	wc, err := fs.store.CreateWriteCloser(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := wc.Write(header); err != nil {
+		_ = wc.Close()
+		return nil, err
+	}
+	return &encryptedWriteCloser{
+		wc:   wc,
+		aead: aead,
+		buf:  make([]byte, 0, fs.chunkSize),
+	}, nil
+}
+
+func (fs *encryptingStreamStore) OpenReadCloser(name string) (straw.StrawReader, error) {
+	rc, err := fs.store.OpenReadCloser(name)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(rc)
+	magic, err := br.Peek(len(encryptionMagic))
+	switch {
+	case err != nil && !isTruncated(err):
+		_ = rc.Close()
+		return nil, err
+	case err != nil && (!fs.allowPlaintext || bytes.HasPrefix(encryptionMagic, magic)):
+		// too short to tell, probably because it is still being
+		// written.
+		return &decryptedReadCloser{inner: rc, err: errIncomplete}, nil
+	case !bytes.Equal(magic, encryptionMagic):
+		if !fs.allowPlaintext {
+			_ = rc.Close()
+			return nil, fmt.Errorf("could not read %v (%w)", name, ErrNotEncrypted)
+		}
+		return &compressedReadCloser{io.NopCloser(br), rc}, nil
+	}
+
+	aead, chunkSize, err := fs.readHeader(br)
+	if err != nil {
+		if isTruncated(err) {
+			return &decryptedReadCloser{inner: rc, err: errIncomplete}, nil
+		}
+		_ = rc.Close()
+		return nil, fmt.Errorf("could not read encryption header of %v (%w)", name, err)
+	}
+	return &decryptedReadCloser{
+		r:     br,
+		inner: rc,
+		aead:  aead,
+		buf:   make([]byte, chunkSize+aead.Overhead()),
+	}, nil
+}
+
+// readHeader reads the header of an encrypted file, returning the cipher for
+// its data key and its chunk size.
+func (fs *encryptingStreamStore) readHeader(br *bufio.Reader) (cipher.AEAD, int, error) {
+	header := make([]byte, len(encryptionMagic)+2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, 0, err
+	}
+	if v := header[len(encryptionMagic)]; v != encryptionVersion {
+		return nil, 0, fmt.Errorf("unsupported encryption version %d", v)
+	}
+	keyID := make([]byte, header[len(encryptionMagic)+1])
+	if _, err := io.ReadFull(br, keyID); err != nil {
+		return nil, 0, err
+	}
+	header = append(header, keyID...)
+	var cs [4]byte
+	if _, err := io.ReadFull(br, cs[:]); err != nil {
+		return nil, 0, err
+	}
+	header = append(header, cs[:]...)
+	chunkSize := int(binary.LittleEndian.Uint32(cs[:]))
+	if chunkSize == 0 || chunkSize > maxEncryptionChunkSize {
+		return nil, 0, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+
+	key, err := fs.keys.Key(string(keyID))
+	if err != nil {
+		return nil, 0, err
+	}
+	kek, err := newGCM(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	wrapped := make([]byte, kek.NonceSize()+dataKeyLen+kek.Overhead())
+	if _, err := io.ReadFull(br, wrapped); err != nil {
+		return nil, 0, err
+	}
+	nonce := wrapped[:kek.NonceSize()]
+	dataKey, err := kek.Open(nil, nonce, wrapped[len(nonce):], header)
+	if err != nil {
+		return nil, 0, ErrDecryptionFailed
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	return aead, chunkSize, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of the chunk with the given index.
+func chunkNonce(aead cipher.AEAD, index uint64, final bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, index)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+type encryptedWriteCloser struct {
+	wc    io.WriteCloser
+	aead  cipher.AEAD
+	index uint64
+	buf   []byte
+	out   []byte
+}
+
+func (w *encryptedWriteCloser) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+		if len(w.buf) == cap(w.buf) {
+			if err := w.writeChunk(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *encryptedWriteCloser) writeChunk(final bool) error {
+	w.out = w.aead.Seal(w.out[:0], chunkNonce(w.aead, w.index, final), w.buf, nil)
+	w.index++
+	w.buf = w.buf[:0]
+	_, err := w.wc.Write(w.out)
+	return err
+}
+
+func (w *encryptedWriteCloser) Close() error {
+	if err := w.writeChunk(true); err != nil {
+		_ = w.wc.Close()
+		return err
+	}
+	return w.wc.Close()
+}
+
+type decryptedReadCloser struct {
+	r     io.Reader
+	inner io.Closer
+	aead  cipher.AEAD
+	index uint64
+	buf   []byte
+	plain []byte
+	// done is set once the final chunk has been read.
+	done bool
+	err  error
+}
+
+func (r *decryptedReadCloser) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		r.plain, r.err = r.readChunk()
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// readChunk reads and decrypts the next chunk. A chunk that is shorter than
+// the chunk size is the final one. If it fails to decrypt as such, the file
+// ends before its final chunk, so errIncomplete is returned.
+func (r *decryptedReadCloser) readChunk() ([]byte, error) {
+	n, err := io.ReadFull(r.r, r.buf)
+	switch err {
+	case nil:
+		plain, err := r.aead.Open(r.buf[:0], chunkNonce(r.aead, r.index, false), r.buf, nil)
+		if err != nil {
+			return nil, ErrDecryptionFailed
+		}
+		r.index++
+		return plain, nil
+	case io.EOF, io.ErrUnexpectedEOF:
+		plain, err := r.aead.Open(r.buf[:0], chunkNonce(r.aead, r.index, true), r.buf[:n], nil)
+		if err != nil {
+			return nil, errIncomplete
+		}
+		r.done = true
+		return plain, nil
+	}
+	return nil, err
+}
+
+func (r *decryptedReadCloser) Close() error {
+	return r.inner.Close()
+}
+
+func (r *decryptedReadCloser) Seek(int64, int) (int64, error) {
+	panic("freezer: Seek not supported in decrypted read closer")
+}
+
+func (r *decryptedReadCloser) ReadAt([]byte, int64) (int, error) {
+	panic("freezer: ReadAt not supported in decrypted read closer")
+}
@@ -0,0 +1,164 @@
+package freezer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+)
+
+func testKeys(current string) StaticKeys {
+	return StaticKeys{
+		CurrentID: current,
+		Keys: map[string][]byte{
+			"a": bytes.Repeat([]byte{1}, 32),
+			"b": bytes.Repeat([]byte{2}, 16),
+		},
+	}
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	mem, _ := straw.Open("mem://")
+
+	secret := []byte("a secret message")
+	for _, current := range []string{"a", "b"} {
+		ss, err := NewEncryptingStreamStore(mem, EncryptionConfig{Keys: testKeys(current), ChunkSize: 16})
+		require.NoError(err)
+		sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo", CompressionType: CompressionTypeSnappy, WriteHeader: true, Checksums: true})
+		require.NoError(err)
+		assert.NoError(sink.PutMessages([][]byte{secret, {1}}))
+		assert.NoError(sink.Close())
+	}
+
+	// the batches are not stored in the clear.
+	for seq := 0; seq < 2; seq++ {
+		rc, err := mem.OpenReadCloser(seqToPath("/foo", seq))
+		require.NoError(err)
+		data, err := io.ReadAll(rc)
+		require.NoError(err)
+		rc.Close()
+		assert.False(bytes.Contains(data, secret))
+	}
+
+	// the source finds the key each batch was encrypted with, after the
+	// current key has changed.
+	ss, err := NewEncryptingStreamStore(mem, EncryptionConfig{Keys: testKeys("b")})
+	require.NoError(err)
+	source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", StopAtEnd: true})
+
+	got, err := consumeAll(context.Background(), source)
+	assert.NoError(err)
+	assert.Equal([][]byte{secret, {1}, secret, {1}}, got)
+}
+
+func TestEncryptionErrors(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	mem, _ := straw.Open("mem://")
+	_, err := NewEncryptingStreamStore(mem, EncryptionConfig{Keys: testKeys("a"), ChunkSize: 32 << 20})
+	assert.EqualError(err, "invalid chunk size 33554432")
+	ss, err := NewEncryptingStreamStore(mem, EncryptionConfig{Keys: testKeys("a"), ChunkSize: 16})
+	require.NoError(err)
+
+	writeFile(t, ss, "/encrypted", bytes.Repeat([]byte{3}, 100))
+	writeFile(t, mem, "/plain", []byte("plaintext"))
+
+	rc, err := ss.OpenReadCloser("/encrypted")
+	require.NoError(err)
+	data, err := io.ReadAll(rc)
+	assert.NoError(err)
+	assert.Equal(bytes.Repeat([]byte{3}, 100), data)
+
+	// altering a chunk is detected.
+	rc, err = mem.OpenReadCloser("/encrypted")
+	require.NoError(err)
+	data, err = io.ReadAll(rc)
+	require.NoError(err)
+	data[len(data)-50] ^= 1
+	writeFile(t, mem, "/encrypted", data)
+
+	rc, err = ss.OpenReadCloser("/encrypted")
+	require.NoError(err)
+	_, err = io.ReadAll(rc)
+	assert.Equal(ErrDecryptionFailed, err)
+
+	// as are altering the final chunk, removing it, which truncates the
+	// file at a chunk boundary, and truncating the header.
+	data[len(data)-50] ^= 1
+	for name, altered := range map[string][]byte{
+		"tampered":  append(append([]byte{}, data[:len(data)-1]...), data[len(data)-1]^1),
+		"truncated": data[:len(data)-20],
+		"header":    data[:2],
+	} {
+		writeFile(t, mem, "/altered", altered)
+		rc, err = ss.OpenReadCloser("/altered")
+		require.NoError(err)
+		_, err = io.ReadAll(rc)
+		assert.True(errors.Is(err, ErrDecryptionFailed), name)
+	}
+
+	// unknown keys and plaintext are refused.
+	other, err := NewEncryptingStreamStore(mem, EncryptionConfig{Keys: StaticKeys{}})
+	require.NoError(err)
+	_, err = other.OpenReadCloser("/encrypted")
+	assert.EqualError(err, `could not read encryption header of /encrypted (unknown key "a")`)
+
+	_, err = ss.OpenReadCloser("/plain")
+	assert.True(errors.Is(err, ErrNotEncrypted))
+
+	lenient, err := NewEncryptingStreamStore(mem, EncryptionConfig{Keys: testKeys("a"), AllowPlaintext: true})
+	require.NoError(err)
+	rc, err = lenient.OpenReadCloser("/plain")
+	require.NoError(err)
+	data, err = io.ReadAll(rc)
+	assert.NoError(err)
+	assert.Equal([]byte("plaintext"), data)
+}
+
+func TestEncryptedBatchBeingWritten(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	mem, _ := straw.Open("mem://")
+	ss, err := NewEncryptingStreamStore(mem, EncryptionConfig{Keys: testKeys("a"), ChunkSize: 16})
+	require.NoError(err)
+
+	sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo"})
+	require.NoError(err)
+	first := bytes.Repeat([]byte{1}, 20)
+	assert.NoError(sink.PutMessage(first))
+
+	source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", PollPeriod: 5 * time.Millisecond})
+	r, err := source.NewReader()
+	require.NoError(err)
+	defer r.Close()
+
+	// only the first chunk of the message has been written, so the reader
+	// waits for the rest rather than failing to decrypt the batch.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	_, err = r.Next(ctx)
+	assert.Equal(context.DeadlineExceeded, err)
+
+	assert.NoError(sink.PutMessage([]byte{2}))
+	assert.NoError(sink.Close())
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	m, err := r.Next(ctx)
+	require.NoError(err)
+	assert.Equal(first, m.Data)
+	m, err = r.Next(ctx)
+	require.NoError(err)
+	assert.Equal([]byte{2}, m.Data)
+}
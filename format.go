@@ -0,0 +1,294 @@
+package freezer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/uw-labs/straw"
+)
+
+// A batch file is a sequence of records, each of which is a 4 byte little
+// endian payload length followed by the payload. The batch is ended by a
+// record with zero length, after which there is no more data.
+//
+// A batch may start with a format marker, which is a length of formatMarker
+// followed by a format version byte and a flags byte. The flags enable
+// additional record fields:
+//
+//   - flagChecksums: each non-empty record has a 4 byte little endian
+//     CRC-32C of its payload between the length and the payload.
+//   - flagSigned: the end marker is followed by a signature trailer,
+//     described in signing.go.
+//
+// Batches without a format marker have no flags set.
+
+var endMarker = []byte{0, 0, 0, 0}
+
+const (
+	formatMarker    = 0xffffffff
+	formatVersion   = 2
+	formatHeaderLen = 6
+
+	flagChecksums byte = 1 << 0
+	flagSigned    byte = 1 << 1
+
+	knownFlags = flagChecksums | flagSigned
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// CorruptionError is returned when a message read from a batch does not match
+// its checksum.
+type CorruptionError struct {
+	// Path is the path of the batch file.
+	Path string
+	// Offset is the byte offset of the corrupt record within the
+	// uncompressed batch file.
+	Offset int64
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corrupt message in %v at offset %d", e.Path, e.Offset)
+}
+
+// writeFormatHeader writes the format marker for the given flags, if any are
+// set. Batches without flags are written without a marker, so that they can be
+// read by older versions.
+func writeFormatHeader(w io.Writer, flags byte) error {
+	if flags == 0 {
+		return nil
+	}
+	var header [formatHeaderLen]byte
+	binary.LittleEndian.PutUint32(header[:], formatMarker)
+	header[4] = formatVersion
+	header[5] = flags
+	_, err := w.Write(header[:])
+	return err
+}
+
+func writeRecord(w io.Writer, flags byte, m []byte) error {
+	var prefix [8]byte
+	binary.LittleEndian.PutUint32(prefix[:], uint32(len(m)))
+	n := 4
+	if flags&flagChecksums != 0 {
+		binary.LittleEndian.PutUint32(prefix[4:], crc32.Checksum(m, crcTable))
+		n = 8
+	}
+	if _, err := w.Write(prefix[:n]); err != nil {
+		return err
+	}
+	_, err := w.Write(m)
+	return err
+}
+
+// recordReader reads the records of a batch.
+type recordReader struct {
+	r    io.Reader
+	path string
+	// offset is the offset of the next record within the uncompressed
+	// batch file.
+	offset int64
+	// last is the offset of the record last returned by next.
+	last  int64
+	flags byte
+
+	// keyID and signature are read from the trailer of a signed batch,
+	// which covers the first signed bytes of the uncompressed batch.
+	keyID     string
+	signature []byte
+	signed    int64
+
+	// buf holds what has been read of the record at offset, which may not
+	// have been written in full yet.
+	buf []byte
+}
+
+// next returns the payload of the next record, or false if the end marker has
+// been reached. It returns io.EOF if there is no more data yet, and an error
+// wrapping io.ErrUnexpectedEOF if the data ends part way through the record.
+// In either case, it may be called again once more data is available from the
+// underlying reader, or it has been replaced with one positioned at offset.
+func (rr *recordReader) next() ([]byte, bool, error) {
+	if err := rr.fill(4); err != nil {
+		if err == io.EOF {
+			return nil, false, io.EOF
+		}
+		return nil, false, fmt.Errorf("Could not read length (%w)", err)
+	}
+
+	len := binary.LittleEndian.Uint32(rr.buf)
+	if len == formatMarker && rr.offset == 0 {
+		if err := rr.readFormat(); err != nil {
+			return nil, false, err
+		}
+		return rr.next()
+	}
+	if len == 0 {
+		if rr.flags&flagSigned != 0 {
+			if err := rr.readSignature(); err != nil {
+				return nil, false, err
+			}
+		}
+		// next read should be EOF
+		buf := []byte{0}
+		if _, err := rr.r.Read(buf); err != io.EOF {
+			return nil, false, fmt.Errorf("Was able to read past end marker. This is broken, bailing out.")
+		}
+		return nil, false, nil
+	}
+
+	prefixLen := 4
+	if rr.flags&flagChecksums != 0 {
+		if err := rr.fill(8); err != nil {
+			return nil, false, fmt.Errorf("Could not read checksum from %v (%w)", rr.path, err)
+		}
+		prefixLen = 8
+	}
+	if err := rr.fill(prefixLen + int(len)); err != nil {
+		return nil, false, fmt.Errorf("Could not read payload from %v. Expected len was %d. (%w)", rr.path, len, err)
+	}
+	buf := rr.buf[prefixLen:]
+	if rr.flags&flagChecksums != 0 && crc32.Checksum(buf, crcTable) != binary.LittleEndian.Uint32(rr.buf[4:8]) {
+		return nil, false, &CorruptionError{Path: rr.path, Offset: rr.offset}
+	}
+	rr.buf = nil
+	rr.last = rr.offset
+	rr.offset += int64(prefixLen) + int64(len)
+	return buf, true, nil
+}
+
+// fill reads from the underlying reader until buf holds the first n bytes of
+// the record at offset. It returns io.EOF if none of the record has been read,
+// and io.ErrUnexpectedEOF if only some of it has.
+func (rr *recordReader) fill(n int) error {
+	if cap(rr.buf) < n {
+		buf := make([]byte, len(rr.buf), n)
+		copy(buf, rr.buf)
+		rr.buf = buf
+	}
+	for len(rr.buf) < n {
+		m, err := rr.r.Read(rr.buf[len(rr.buf):n])
+		rr.buf = rr.buf[:len(rr.buf)+m]
+		if err == io.EOF && len(rr.buf) < n {
+			if len(rr.buf) == 0 {
+				return io.EOF
+			}
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+	return nil
+}
+
+// consumed returns the number of bytes read from the underlying reader.
+func (rr *recordReader) consumed() int64 {
+	return rr.offset + int64(len(rr.buf))
+}
+
+// reset discards what has been read of the record at offset, for when the
+// underlying reader is replaced with one positioned at offset.
+func (rr *recordReader) reset(r io.Reader) {
+	rr.r = r
+	rr.buf = nil
+}
+
+func (rr *recordReader) readFormat() error {
+	if err := rr.fill(formatHeaderLen); err != nil {
+		return fmt.Errorf("Could not read format of %v (%w)", rr.path, err)
+	}
+	version, flags := rr.buf[4], rr.buf[5]
+	if version != formatVersion {
+		return fmt.Errorf("unsupported format version %d in %v", version, rr.path)
+	}
+	if flags&^knownFlags != 0 {
+		return fmt.Errorf("unsupported format flags %#x in %v", flags, rr.path)
+	}
+	rr.flags = flags
+	rr.offset = formatHeaderLen
+	rr.buf = nil
+	return nil
+}
+
+// scanBatch reads the batch file at path, calling fn (if not nil) with the
+// payload of each complete record. It reports whether the batch ends with the
+// end marker. Data truncated part way through a record is not an error, as it
+// is expected while the batch is still being written.
+func scanBatch(ss straw.StreamStore, path string, fn func([]byte) error) (bool, error) {
+	rc, err := ss.OpenReadCloser(path)
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+
+	rr := &recordReader{r: rc, path: path}
+	for {
+		m, ok, err := rr.next()
+		if err != nil {
+			if isTruncated(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		if !ok {
+			return true, nil
+		}
+		if fn != nil {
+			if err := fn(m); err != nil {
+				return false, err
+			}
+		}
+	}
+}
+
+// incompleteError is returned when a file ends before enough of it has been
+// written to be read, which may be because it is still being written. A reader
+// that does not yet know the file to be complete can open it again later. It
+// is also io.ErrUnexpectedEOF, and err, if set.
+type incompleteError struct {
+	msg string
+	err error
+}
+
+func (e *incompleteError) Error() string {
+	return e.msg
+}
+
+func (e *incompleteError) Is(target error) bool {
+	return target == io.ErrUnexpectedEOF || (e.err != nil && target == e.err)
+}
+
+func isIncomplete(err error) bool {
+	var ie *incompleteError
+	return errors.As(err, &ie)
+}
+
+// incompleteReadCloser fails every read with an *incompleteError, for a file
+// that cannot be read until more of it has been written.
+type incompleteReadCloser struct {
+	io.Closer
+	err error
+}
+
+func (r *incompleteReadCloser) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+func (r *incompleteReadCloser) Seek(int64, int) (int64, error) {
+	panic("freezer: Seek not supported in incomplete read closer")
+}
+
+func (r *incompleteReadCloser) ReadAt([]byte, int64) (int, error) {
+	panic("freezer: ReadAt not supported in incomplete read closer")
+}
+
+// isTruncated reports whether err is the result of reading a file that ends
+// part way through. Other errors, such as corrupt compressed data, are not
+// truncation, so must not be recovered from by dropping the rest of the file.
+func isTruncated(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,87 @@
+package freezer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+)
+
+func TestChecksumsRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo", Checksums: true})
+	require.NoError(err)
+	assert.NoError(sink.PutMessage([]byte{1, 2, 3}))
+	assert.NoError(sink.PutMessage([]byte{4}))
+	assert.NoError(sink.Close())
+
+	source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", StopAtEnd: true})
+
+	var got []Message
+	assert.NoError(source.Consume(context.Background(), func(m Message) error {
+		got = append(got, m)
+		return nil
+	}))
+	require.Equal(2, len(got))
+	assert.Equal([]byte{1, 2, 3}, got[0].Data)
+	assert.Equal(int64(formatHeaderLen), got[0].Offset)
+	assert.Equal([]byte{4}, got[1].Data)
+	assert.Equal(int64(formatHeaderLen+8+3), got[1].Offset)
+
+	// flip a bit in the payload of the second message.
+	rc, err := ss.OpenReadCloser(seqToPath("/foo", 0))
+	require.NoError(err)
+	data, err := io.ReadAll(rc)
+	require.NoError(err)
+	data[formatHeaderLen+8+3+8] ^= 1
+	writeFile(t, ss, seqToPath("/foo", 0), data)
+
+	err = source.ConsumeMessages(context.Background(), func([]byte) error { return nil })
+	assert.Equal(&CorruptionError{Path: "/foo/00/00/00/00/00/00/00", Offset: formatHeaderLen + 8 + 3}, err)
+}
+
+func TestUnsupportedFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	ss := newMockStrawStore(append(length(formatMarker), 3, 0))
+	source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo"})
+
+	err := source.ConsumeMessages(context.Background(), func([]byte) error { return nil })
+	assert.EqualError(err, "unsupported format version 3 in /foo/00/00/00/00/00/00/00")
+}
+
+func TestRecordReaderResumes(t *testing.T) {
+	assert := assert.New(t)
+
+	// a reader of a file that is still being written, which carries on
+	// returning data after io.EOF once more has been written.
+	var file bytes.Buffer
+	rr := &recordReader{r: &file, path: "/foo"}
+
+	_, _, err := rr.next()
+	assert.Equal(io.EOF, err)
+
+	file.Write(append(length(3), 1))
+	_, _, err = rr.next()
+	assert.True(errors.Is(err, io.ErrUnexpectedEOF))
+
+	file.Write([]byte{2, 3})
+	m, ok, err := rr.next()
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal([]byte{1, 2, 3}, m)
+
+	file.Write(delim)
+	_, ok, err = rr.next()
+	assert.NoError(err)
+	assert.False(ok)
+}
@@ -1,6 +1,7 @@
 package freezer
 
 import (
+	"context"
 	"errors"
 	"time"
 
@@ -10,21 +11,50 @@ import (
 type MessageSinkAutoFlush struct {
 	ms *MessageSink
 
-	maxUnflushedTime     time.Duration
-	maxUnflushedMessages int
+	maxUnflushedTime            time.Duration
+	maxUnflushedMessages        int
+	maxUnflushedBytes           int64
+	maxUnflushedCompressedBytes int64
+
+	onFlush func(BatchInfo)
 
 	reqs chan *messageReqAf
 
+	flushReqs chan *flushReq
+
 	exitErr  error
 	closeReq chan struct{}
 	closed   chan struct{}
 }
 
 type MessageSinkAutoFlushConfig struct {
-	Path                 string
-	MaxUnflushedTime     time.Duration
-	MaxUnflushedMessages int
-	CompressionType      CompressionType
+	Path                  string
+	MaxUnflushedTime      time.Duration
+	MaxUnflushedMessages  int
+	CompressionType       CompressionType
+	Zstd                  ZstdOptions
+	ZstdDictionarySamples [][]byte
+	WriteHeader           bool
+	Checksums             bool
+	Recovery              RecoveryPolicy
+	SealTimeout           time.Duration
+	Fencing               FencingPolicy
+	LeaseTTL              time.Duration
+	AtomicPublish         bool
+	Signer                Signer
+
+	// MaxUnflushedBytes is the size of a batch, before compression, at
+	// which it is flushed.
+	MaxUnflushedBytes int64
+	// MaxUnflushedCompressedBytes is the size of a batch, after
+	// compression, at which it is flushed. Compressors buffer data, so
+	// batches may exceed this by up to the compressor's buffer size.
+	MaxUnflushedCompressedBytes int64
+
+	// OnFlush, if set, is called with each batch the sink seals, once it
+	// has been sealed. It is called from the sink's goroutine, so the sink
+	// does not accept messages until it returns.
+	OnFlush func(BatchInfo)
 }
 
 const (
@@ -38,8 +68,18 @@ func NewMessageAutoFlushSink(streamstore straw.StreamStore, config MessageSinkAu
 	}
 
 	ms, err := NewMessageSink(streamstore, MessageSinkConfig{
-		Path:            config.Path,
-		CompressionType: config.CompressionType,
+		Path:                  config.Path,
+		CompressionType:       config.CompressionType,
+		Zstd:                  config.Zstd,
+		ZstdDictionarySamples: config.ZstdDictionarySamples,
+		WriteHeader:           config.WriteHeader,
+		Checksums:             config.Checksums,
+		Recovery:              config.Recovery,
+		SealTimeout:           config.SealTimeout,
+		Fencing:               config.Fencing,
+		LeaseTTL:              config.LeaseTTL,
+		AtomicPublish:         config.AtomicPublish,
+		Signer:                config.Signer,
 	})
 	if err != nil {
 		return nil, err
@@ -48,11 +88,17 @@ func NewMessageAutoFlushSink(streamstore straw.StreamStore, config MessageSinkAu
 	msa := &MessageSinkAutoFlush{
 		ms: ms,
 
-		maxUnflushedTime:     config.MaxUnflushedTime,
-		maxUnflushedMessages: config.MaxUnflushedMessages,
+		maxUnflushedTime:            config.MaxUnflushedTime,
+		maxUnflushedMessages:        config.MaxUnflushedMessages,
+		maxUnflushedBytes:           config.MaxUnflushedBytes,
+		maxUnflushedCompressedBytes: config.MaxUnflushedCompressedBytes,
+
+		onFlush: config.OnFlush,
 
 		reqs: make(chan *messageReqAf),
 
+		flushReqs: make(chan *flushReq),
+
 		closeReq: make(chan struct{}),
 		closed:   make(chan struct{}),
 	}
@@ -86,13 +132,16 @@ func (mq *MessageSinkAutoFlush) loop() error {
 		}
 		select {
 		case r := <-mq.reqs:
-			err := mq.ms.PutMessage(r.m)
+			stats, err := mq.ms.putMessages(context.Background(), r.m, r.future)
 			if err != nil {
+				if r.future != nil {
+					r.future.resolve(err)
+				}
 				return err
 			}
 			close(r.writtenOk)
-			writtenCount++
-			if writtenCount == mq.maxUnflushedMessages {
+			writtenCount += len(r.m)
+			if (mq.maxUnflushedMessages > 0 && writtenCount >= mq.maxUnflushedMessages) || mq.sizeExceeded(stats) {
 				flushNeeded = true
 			} else if t == nil {
 				t = time.NewTimer(mq.maxUnflushedTime)
@@ -100,16 +149,25 @@ func (mq *MessageSinkAutoFlush) loop() error {
 		case <-timerC:
 			t = nil
 			flushNeeded = true
+		case fr := <-mq.flushReqs:
+			info, err := mq.flush()
+			if err != nil {
+				return err
+			}
+			writtenCount = 0
+			fr.info = info
+			close(fr.flushedOk)
 		case <-mq.closeReq:
 			if writtenCount != 0 {
-				if err := mq.ms.Flush(); err != nil {
+				if _, err := mq.flush(); err != nil {
 					return err
 				}
 			}
-			return nil
+			// closing the inner sink releases its lease.
+			return mq.ms.Close()
 		}
 		if flushNeeded {
-			if err := mq.ms.Flush(); err != nil {
+			if _, err := mq.flush(); err != nil {
 				return err
 			}
 			writtenCount = 0
@@ -118,13 +176,85 @@ func (mq *MessageSinkAutoFlush) loop() error {
 	}
 }
 
+// flush seals the current batch, if any, and reports it to the OnFlush callback.
+func (mq *MessageSinkAutoFlush) flush() (*BatchInfo, error) {
+	info, err := mq.ms.FlushBatch()
+	if err != nil {
+		return nil, err
+	}
+	if info != nil && mq.onFlush != nil {
+		mq.onFlush(*info)
+	}
+	return info, nil
+}
+
+func (mq *MessageSinkAutoFlush) sizeExceeded(stats batchStats) bool {
+	return (mq.maxUnflushedBytes > 0 && stats.bytes >= mq.maxUnflushedBytes) ||
+		(mq.maxUnflushedCompressedBytes > 0 && stats.storedBytes >= mq.maxUnflushedCompressedBytes)
+}
+
 type messageReqAf struct {
-	m         []byte
+	m         [][]byte
 	writtenOk chan struct{}
+	future    *PutFuture
 }
 
 func (mq *MessageSinkAutoFlush) PutMessage(m []byte) error {
-	req := &messageReqAf{m, make(chan struct{})}
+	return mq.PutMessageContext(context.Background(), m)
+}
+
+// PutMessageContext is like PutMessage, but stops waiting for the message to
+// be written when ctx is done. The message may still be written after that.
+func (mq *MessageSinkAutoFlush) PutMessageContext(ctx context.Context, m []byte) error {
+	return mq.putMessages(ctx, [][]byte{m})
+}
+
+// PutMessages writes several messages at once, which is cheaper than calling
+// PutMessage for each of them. The messages are all written to the same
+// batch, so it may exceed MaxUnflushedMessages or MaxUnflushedBytes.
+func (mq *MessageSinkAutoFlush) PutMessages(ms [][]byte) error {
+	return mq.PutMessagesContext(context.Background(), ms)
+}
+
+// PutMessagesContext is like PutMessages, but stops waiting for the messages
+// to be written when ctx is done. They may still be written after that.
+func (mq *MessageSinkAutoFlush) PutMessagesContext(ctx context.Context, ms [][]byte) error {
+	if len(ms) == 0 {
+		return nil
+	}
+	return mq.putMessages(ctx, ms)
+}
+
+// PutMessageAsync writes a message without waiting for it to be written. The
+// returned future is resolved when the batch containing it has been sealed, or
+// writing it has failed. The message is copied, so m may be reused as soon as
+// PutMessageAsync returns.
+func (mq *MessageSinkAutoFlush) PutMessageAsync(m []byte) *PutFuture {
+	return mq.PutMessagesAsync([][]byte{m})
+}
+
+// PutMessagesAsync is like PutMessageAsync, but for several messages at once.
+func (mq *MessageSinkAutoFlush) PutMessagesAsync(ms [][]byte) *PutFuture {
+	f := newPutFuture()
+	if len(ms) == 0 {
+		f.resolve(nil)
+		return f
+	}
+	req := &messageReqAf{copyMessages(ms), make(chan struct{}), f}
+	select {
+	case mq.reqs <- req:
+	case <-mq.closed:
+		err := mq.exitErr
+		if err == nil {
+			err = errors.New("already closed")
+		}
+		f.resolve(err)
+	}
+	return f
+}
+
+func (mq *MessageSinkAutoFlush) putMessages(ctx context.Context, ms [][]byte) error {
+	req := &messageReqAf{ms, make(chan struct{}), nil}
 	select {
 	case mq.reqs <- req:
 		select {
@@ -132,18 +262,68 @@ func (mq *MessageSinkAutoFlush) PutMessage(m []byte) error {
 			return nil
 		case <-mq.closed:
 			return mq.exitErr
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	case <-mq.closed:
 		return mq.exitErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Flush seals the current batch without waiting for a flush threshold to be
+// reached.
+func (mq *MessageSinkAutoFlush) Flush() error {
+	_, err := mq.FlushBatch()
+	return err
+}
+
+// FlushBatch is like Flush, but also describes the batch that was sealed. It
+// returns nil if there was no batch to seal.
+func (mq *MessageSinkAutoFlush) FlushBatch() (*BatchInfo, error) {
+	return mq.FlushBatchContext(context.Background())
+}
+
+// FlushBatchContext is like FlushBatch, but stops waiting for the batch to be
+// sealed when ctx is done. The batch may still be sealed after that.
+func (mq *MessageSinkAutoFlush) FlushBatchContext(ctx context.Context) (*BatchInfo, error) {
+	req := &flushReq{flushedOk: make(chan struct{})}
+	select {
+	case mq.flushReqs <- req:
+		select {
+		case <-req.flushedOk:
+			return req.info, nil
+		case <-mq.closed:
+			return nil, mq.exitErr
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	case <-mq.closed:
+		return nil, mq.exitErr
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 }
 
 func (mq *MessageSinkAutoFlush) Close() error {
+	return mq.CloseContext(context.Background())
+}
+
+// CloseContext is like Close, but stops waiting for the sink to close when ctx
+// is done. The sink carries on closing in the background after that.
+func (mq *MessageSinkAutoFlush) CloseContext(ctx context.Context) error {
 	select {
 	case mq.closeReq <- struct{}{}:
-		<-mq.closed
-		return mq.exitErr
+		select {
+		case <-mq.closed:
+			return mq.exitErr
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	case <-mq.closed:
 		return errors.New("already closed")
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
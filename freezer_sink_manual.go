@@ -1,22 +1,43 @@
 package freezer
 
 import (
-	"encoding/binary"
+	"context"
+	"crypto/sha256"
 	"errors"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
+	"sync/atomic"
+	"time"
 
 	"github.com/uw-labs/straw"
 )
 
 type MessageSink struct {
-	streamstore straw.StreamStore
-	path        string
+	store         straw.StreamStore
+	streamstore   straw.StreamStore
+	path          string
+	flags         byte
+	sealTimeout   time.Duration
+	atomicPublish bool
+
+	fencing  FencingPolicy
+	leaseTTL time.Duration
+	epoch    int64
+
+	signer Signer
+	// digest hashes the current batch, if it is to be signed. It is only
+	// accessed by the loop goroutine, and while sealing.
+	digest hash.Hash
 
 	reqs chan *messageReq
 
-	flushReqs chan flushReq
+	flushReqs chan *flushReq
+
+	// pending are the futures for messages in the current batch. It is
+	// only accessed by the loop goroutine.
+	pending []*PutFuture
 
 	exitErr  error
 	closeReq chan struct{}
@@ -26,10 +47,71 @@ type MessageSink struct {
 type MessageSinkConfig struct {
 	Path            string
 	CompressionType CompressionType
+
+	// Zstd tunes compression when CompressionType is CompressionTypeZstd.
+	Zstd ZstdOptions
+	// ZstdDictionarySamples, if set, are typical messages from which a zstd
+	// dictionary is trained, which greatly improves the compression of
+	// small messages. The dictionary is stored in the stream directory,
+	// and is shared by sinks given the same samples. Batches compressed
+	// with a dictionary always have a header identifying it, so that
+	// sources can load it, and cannot be read by versions of freezer that
+	// predate dictionaries. Requires CompressionTypeZstd.
+	ZstdDictionarySamples [][]byte
+
+	// WriteHeader starts each batch file with a header naming its
+	// compression type, so that sources can read it whatever compression
+	// type they are configured with. This allows a stream to move to a
+	// different compression type without reconfiguring its sources first.
+	// Batches with headers cannot be read by versions of freezer that
+	// predate them.
+	WriteHeader bool
+
+	// Checksums enables a CRC-32C checksum for each message, which is
+	// verified by MessageSource. Batches with checksums cannot be read by
+	// versions of freezer that predate them.
+	Checksums bool
+
+	// SealTimeout, if set, is how long the sink waits for a batch to be
+	// sealed (for example, uploaded) before giving up with ErrSealTimeout.
+	SealTimeout time.Duration
+
+	// Fencing determines how the sink guards against other sinks writing
+	// to the same stream.
+	Fencing FencingPolicy
+	// LeaseTTL is how long the lease taken by a sink with fencing lasts
+	// without being renewed. Leases are renewed whenever a batch is
+	// started, so this should be longer than it takes to write a batch.
+	// The default is DefaultLeaseTTL.
+	LeaseTTL time.Duration
+
+	// AtomicPublish makes the sink write each batch under a temporary name,
+	// and only move it to its final path once it is sealed. This uses Rename
+	// if the store implements Renamer, as the store returned by
+	// NewOSStreamStore does, so readers never see a partial batch. Other
+	// stores have the batch copied to its final path. Readers of object
+	// stores such as S3 and GCS still only see complete batches, as objects
+	// appear once they have been written in full, but each batch is written
+	// twice. Readers of other stores, including straw's own file:// store,
+	// may see a partial batch while it is copied.
+	AtomicPublish bool
+
+	// Recovery determines what happens to a last batch that was left
+	// unterminated, for example because a previous writer crashed.
+	Recovery RecoveryPolicy
+
+	// Signer, if set, signs each batch when it is sealed, so that sources
+	// with a Verifier can check that it has not been altered. Signed
+	// batches cannot be read by versions of freezer that predate them.
+	Signer Signer
 }
 
 func NewMessageSink(streamstore straw.StreamStore, config MessageSinkConfig) (*MessageSink, error) {
 
+	if _, err := codecFor(config.CompressionType); err != nil {
+		return nil, err
+	}
+
 	_, err := streamstore.Stat(config.Path)
 	if os.IsNotExist(err) {
 		if err := straw.MkdirAll(streamstore, config.Path, 0755); err != nil {
@@ -41,27 +123,70 @@ func NewMessageSink(streamstore straw.StreamStore, config MessageSinkConfig) (*M
 		return nil, err
 	}
 
-	switch config.CompressionType {
-	case CompressionTypeNone:
-	case CompressionTypeSnappy:
-		streamstore = newSnappyStreamStore(streamstore)
-	case CompressionTypeZstd:
-		streamstore = newZstdStreamStore(streamstore)
+	css := newCompressionStreamStore(streamstore, config.Path, config.CompressionType, config.WriteHeader)
+	var dict []byte
+	if len(config.ZstdDictionarySamples) != 0 {
+		if config.CompressionType != CompressionTypeZstd {
+			return nil, errors.New("zstd dictionary samples require zstd compression")
+		}
+		css.dictID, dict, err = loadOrTrainDictionary(streamstore, config.Path, config.ZstdDictionarySamples, config.Zstd)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.CompressionType == CompressionTypeZstd && (config.Zstd != (ZstdOptions{}) || dict != nil) {
+		css.codec, err = newZstdCodec(config.Zstd, css.dictID, dict)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	ms := &MessageSink{
-		streamstore: streamstore,
-		path:        config.Path,
-		reqs:        make(chan *messageReq),
+		store:         streamstore,
+		streamstore:   css,
+		path:          config.Path,
+		sealTimeout:   config.SealTimeout,
+		atomicPublish: config.AtomicPublish,
+		fencing:       config.Fencing,
+		leaseTTL:      config.LeaseTTL,
+		signer:        config.Signer,
+		reqs:          make(chan *messageReq),
 
-		flushReqs: make(chan flushReq),
+		flushReqs: make(chan *flushReq),
 
 		closeReq: make(chan struct{}),
 		closed:   make(chan struct{}),
 	}
+	if config.Checksums {
+		ms.flags |= flagChecksums
+	}
+	if config.Signer != nil {
+		ms.flags |= flagSigned
+	}
+	if ms.leaseTTL == 0 {
+		ms.leaseTTL = DefaultLeaseTTL
+	}
+
+	if ms.fencing != FencingNone {
+		if err := ms.acquireLease(); err != nil {
+			return nil, err
+		}
+	}
 
-	nextSeq, err := nextSequence(ms.streamstore, config.Path)
+	// temporary batches are left by sinks with AtomicPublish, and by
+	// recovery, so are dealt with whatever the configuration.
+	nextSeq := 0
+	err = ms.publishTempBatches()
+	if err == nil {
+		nextSeq, err = nextSequence(ms.streamstore, config.Path)
+	}
+	if err == nil && nextSeq > 0 {
+		err = ms.recoverBatch(nextSeq-1, config.Recovery)
+	}
 	if err != nil {
+		if ms.fencing != FencingNone {
+			_ = ms.releaseLease()
+		}
 		return nil, err
 	}
 
@@ -72,22 +197,60 @@ func NewMessageSink(streamstore straw.StreamStore, config MessageSinkConfig) (*M
 
 func (mq *MessageSink) run(nextSeq int) {
 	mq.exitErr = mq.loop(nextSeq)
+	for _, f := range mq.pending {
+		f.resolve(mq.closedErr())
+	}
+	mq.pending = nil
 	close(mq.closed)
 }
 
+// closedErr is the error returned for requests made after the sink has stopped.
+func (mq *MessageSink) closedErr() error {
+	if mq.exitErr != nil {
+		return mq.exitErr
+	}
+	return errors.New("already closed")
+}
+
+// sealed resolves the futures of the batch that has just been sealed.
+func (mq *MessageSink) sealed() {
+	for _, f := range mq.pending {
+		f.resolve(nil)
+	}
+	mq.pending = nil
+}
+
+// batchStats describes the batch being written by a MessageSink.
+type batchStats struct {
+	// messages is the number of messages in the batch.
+	messages int
+	// bytes is the size of the batch before compression.
+	bytes int64
+	// storedBytes is the size of the compressed batch written to the
+	// store so far. Compressors buffer data, so this lags behind bytes.
+	storedBytes int64
+}
+
 func (mq *MessageSink) loop(nextSeq int) error {
-	writtenCount := 0
+	var stats batchStats
 
 	var wc io.WriteCloser
+	var cw *countingWriter
 	var err error
 
 	for {
 		select {
 		case r := <-mq.reqs:
-			var lenBytes [4]byte
-			binary.LittleEndian.PutUint32(lenBytes[:], uint32(len(r.m)))
+			if r.future != nil {
+				mq.pending = append(mq.pending, r.future)
+			}
 			if wc == nil {
-				nextFile := seqToPath(mq.path, nextSeq)
+				if mq.fencing != FencingNone {
+					if err := mq.renewLease(); err != nil {
+						return err
+					}
+				}
+				nextFile := mq.batchPath(nextSeq)
 				if err := straw.MkdirAll(mq.streamstore, filepath.Dir(nextFile), 0755); err != nil {
 					return err
 				}
@@ -95,86 +258,266 @@ func (mq *MessageSink) loop(nextSeq int) error {
 				if err != nil {
 					return err
 				}
+				var w io.Writer = wc
+				if mq.signer != nil {
+					mq.digest = sha256.New()
+					w = io.MultiWriter(wc, mq.digest)
+				}
+				cw = &countingWriter{w: w}
+				if err := writeFormatHeader(cw, mq.flags); err != nil {
+					return err
+				}
 			}
-			if _, err := wc.Write(lenBytes[:]); err != nil {
-				return err
-			}
-			if _, err := wc.Write(r.m); err != nil {
-				return err
+			for _, m := range r.m {
+				if err := writeRecord(cw, mq.flags, m); err != nil {
+					return err
+				}
 			}
+			stats.messages += len(r.m)
+			stats.bytes = atomic.LoadInt64(&cw.n)
+			stats.storedBytes = storedBytes(wc)
+			r.stats = stats
 			close(r.writtenOk)
-			writtenCount++
 		case <-mq.closeReq:
 			if wc != nil {
-				if _, err := wc.Write([]byte{0, 0, 0, 0}); err != nil {
+				if err := mq.seal(wc, nextSeq); err != nil {
 					return err
 				}
-				return wc.Close()
+				mq.sealed()
+			}
+			if mq.fencing != FencingNone {
+				return mq.releaseLease()
 			}
 			return nil
 		case fr := <-mq.flushReqs:
 			if wc != nil {
-				if _, err := wc.Write([]byte{0, 0, 0, 0}); err != nil {
+				if err := mq.seal(wc, nextSeq); err != nil {
 					return err
 				}
-				if err := wc.Close(); err != nil {
-					return err
+				mq.sealed()
+				fr.info = &BatchInfo{
+					Sequence:    nextSeq,
+					Path:        seqToPath(mq.path, nextSeq),
+					Messages:    stats.messages,
+					Bytes:       stats.bytes + int64(len(endMarker)),
+					StoredBytes: storedBytes(wc),
 				}
 				nextSeq++
 				wc = nil
-				writtenCount = 0
+				stats = batchStats{}
 			}
 			close(fr.flushedOk)
 		}
 	}
 }
 
+// ErrSealTimeout is returned by a sink that took longer than its SealTimeout
+// to seal a batch. The sink cannot be used after this.
+var ErrSealTimeout = errors.New("timed out sealing batch")
+
+// seal writes the end marker to the batch being written by wc, closes it and
+// publishes it.
+func (mq *MessageSink) seal(wc io.WriteCloser, seq int) error {
+	if mq.fencing != FencingNone {
+		// a sink that took over the stream may have recovered the batch,
+		// so it must be left alone. It is not closed either, as closing
+		// it may upload it over the recovered batch.
+		if err := mq.renewLease(); err != nil {
+			return err
+		}
+	}
+	if mq.sealTimeout == 0 {
+		return mq.sealBatch(wc, seq)
+	}
+
+	// closing may upload the batch, which can hang, so is abandoned (and
+	// left to finish in the background) if it takes too long.
+	done := make(chan error, 1)
+	go func() {
+		done <- mq.sealBatch(wc, seq)
+	}()
+	t := time.NewTimer(mq.sealTimeout)
+	defer t.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-t.C:
+		return ErrSealTimeout
+	}
+}
+
+func (mq *MessageSink) sealBatch(wc io.WriteCloser, seq int) error {
+	if _, err := wc.Write(endMarker); err != nil {
+		return err
+	}
+	if mq.signer != nil {
+		mq.digest.Write(endMarker)
+		if err := writeSignature(wc, mq.signer, mq.path, seq, mq.digest); err != nil {
+			return err
+		}
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+	return mq.publish(seq)
+}
+
 type messageReq struct {
-	m         []byte
+	m         [][]byte
 	writtenOk chan struct{}
+	// future, if set, is resolved when the batch is sealed.
+	future *PutFuture
+	// stats is set to the stats of the batch once the message is written.
+	stats batchStats
 }
 
 func (mq *MessageSink) PutMessage(m []byte) error {
-	req := &messageReq{m, make(chan struct{})}
+	return mq.PutMessageContext(context.Background(), m)
+}
+
+// PutMessageContext is like PutMessage, but stops waiting for the message to
+// be written when ctx is done. The message may still be written after that.
+func (mq *MessageSink) PutMessageContext(ctx context.Context, m []byte) error {
+	_, err := mq.putMessages(ctx, [][]byte{m}, nil)
+	return err
+}
+
+// PutMessages writes several messages to the current batch at once, which is
+// cheaper than calling PutMessage for each of them.
+func (mq *MessageSink) PutMessages(ms [][]byte) error {
+	return mq.PutMessagesContext(context.Background(), ms)
+}
+
+// PutMessagesContext is like PutMessages, but stops waiting for the messages
+// to be written when ctx is done. They may still be written after that.
+func (mq *MessageSink) PutMessagesContext(ctx context.Context, ms [][]byte) error {
+	if len(ms) == 0 {
+		return nil
+	}
+	_, err := mq.putMessages(ctx, ms, nil)
+	return err
+}
+
+// PutMessageAsync writes a message to the current batch without waiting for
+// it to be written. The returned future is resolved when the batch has been
+// sealed by Flush or Close, or writing it has failed. The message is copied,
+// so m may be reused as soon as PutMessageAsync returns.
+func (mq *MessageSink) PutMessageAsync(m []byte) *PutFuture {
+	return mq.PutMessagesAsync([][]byte{m})
+}
+
+// PutMessagesAsync is like PutMessageAsync, but for several messages at once.
+func (mq *MessageSink) PutMessagesAsync(ms [][]byte) *PutFuture {
+	f := newPutFuture()
+	if len(ms) == 0 {
+		f.resolve(nil)
+		return f
+	}
+	req := &messageReq{m: copyMessages(ms), future: f, writtenOk: make(chan struct{})}
+	select {
+	case mq.reqs <- req:
+	case <-mq.closed:
+		f.resolve(mq.closedErr())
+	}
+	return f
+}
+
+func (mq *MessageSink) putMessages(ctx context.Context, ms [][]byte, f *PutFuture) (batchStats, error) {
+	req := &messageReq{m: ms, future: f, writtenOk: make(chan struct{})}
 	select {
 	case mq.reqs <- req:
 		select {
 		case <-req.writtenOk:
-			return nil
+			return req.stats, nil
 		case <-mq.closed:
-			return mq.exitErr
+			return batchStats{}, mq.exitErr
+		case <-ctx.Done():
+			return batchStats{}, ctx.Err()
 		}
 	case <-mq.closed:
-		return mq.exitErr
+		return batchStats{}, mq.exitErr
+	case <-ctx.Done():
+		return batchStats{}, ctx.Err()
 	}
 }
 
+// BatchInfo describes a batch sealed by a sink.
+type BatchInfo struct {
+	// Sequence is the sequence number of the batch.
+	Sequence int
+	// Path is the path of the batch file.
+	Path string
+	// Messages is the number of messages in the batch.
+	Messages int
+	// Bytes is the size of the batch before compression.
+	Bytes int64
+	// StoredBytes is the size of the batch file written to the store.
+	StoredBytes int64
+}
+
 type flushReq struct {
 	flushedOk chan struct{}
+	// info is set to the sealed batch, if any, before flushedOk is closed.
+	info *BatchInfo
 }
 
 func (mq *MessageSink) Flush() error {
-	req := flushReq{make(chan struct{})}
+	return mq.FlushContext(context.Background())
+}
+
+// FlushContext is like Flush, but stops waiting for the batch to be sealed
+// when ctx is done. The batch may still be sealed after that.
+func (mq *MessageSink) FlushContext(ctx context.Context) error {
+	_, err := mq.FlushBatchContext(ctx)
+	return err
+}
+
+// FlushBatch is like Flush, but also describes the batch that was sealed. It
+// returns nil if there was no batch to seal.
+func (mq *MessageSink) FlushBatch() (*BatchInfo, error) {
+	return mq.FlushBatchContext(context.Background())
+}
+
+// FlushBatchContext is like FlushBatch, but stops waiting for the batch to be
+// sealed when ctx is done. The batch may still be sealed after that.
+func (mq *MessageSink) FlushBatchContext(ctx context.Context) (*BatchInfo, error) {
+	req := &flushReq{flushedOk: make(chan struct{})}
 
 	select {
 	case mq.flushReqs <- req:
 		select {
 		case <-req.flushedOk:
-			return nil
+			return req.info, nil
 		case <-mq.closed:
-			return mq.exitErr
+			return nil, mq.exitErr
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
 	case <-mq.closed:
-		return mq.exitErr
+		return nil, mq.exitErr
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 }
 
 func (mq *MessageSink) Close() error {
+	return mq.CloseContext(context.Background())
+}
+
+// CloseContext is like Close, but stops waiting for the sink to close when ctx
+// is done. The sink carries on closing in the background after that.
+func (mq *MessageSink) CloseContext(ctx context.Context) error {
 	select {
 	case mq.closeReq <- struct{}{}:
-		<-mq.closed
-		return mq.exitErr
+		select {
+		case <-mq.closed:
+			return mq.exitErr
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	case <-mq.closed:
 		return errors.New("already closed")
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
@@ -1,6 +1,7 @@
 package freezer
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -70,3 +71,198 @@ func TestMaxUnflushedMessages(t *testing.T) {
 	assert.Equal("00", fis[0].Name())
 	assert.Equal("01", fis[1].Name())
 }
+
+func TestMaxUnflushedBytes(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	sink, err := NewMessageAutoFlushSink(ss, MessageSinkAutoFlushConfig{Path: "/foo/", MaxUnflushedTime: 5 * time.Second, MaxUnflushedBytes: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each message takes 7 bytes with its length.
+	assert.NoError(sink.PutMessage([]byte{1, 1, 1}))
+	assert.NoError(sink.PutMessage([]byte{2, 2, 2}))
+	assert.NoError(sink.PutMessage([]byte{3, 3, 3}))
+	assert.NoError(sink.Close())
+
+	fis, err := ss.Readdir("/foo/00/00/00/00/00/00/")
+	require.NoError(err)
+
+	assert.Equal(2, len(fis))
+	assert.Equal("00", fis[0].Name())
+	assert.Equal("01", fis[1].Name())
+}
+
+func TestMaxUnflushedCompressedBytes(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	// snappy buffers its input, and only writes a chunk once it has 64KiB.
+	sink, err := NewMessageAutoFlushSink(ss, MessageSinkAutoFlushConfig{Path: "/foo/", MaxUnflushedTime: 5 * time.Second, CompressionType: CompressionTypeSnappy, MaxUnflushedCompressedBytes: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := make([]byte, 1024)
+	for i := 0; i < 100; i++ {
+		assert.NoError(sink.PutMessage(m))
+	}
+	assert.NoError(sink.Close())
+
+	fis, err := ss.Readdir("/foo/00/00/00/00/00/00/")
+	require.NoError(err)
+
+	assert.Equal(2, len(fis))
+}
+
+func TestPutMessages(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	sink, err := NewMessageAutoFlushSink(ss, MessageSinkAutoFlushConfig{Path: "/foo", MaxUnflushedTime: 5 * time.Second, MaxUnflushedMessages: 2})
+	require.NoError(err)
+
+	assert.NoError(sink.PutMessages([][]byte{{1}, {2}, {3}}))
+	assert.NoError(sink.PutMessages(nil))
+	assert.NoError(sink.PutMessage([]byte{4}))
+	assert.NoError(sink.Close())
+
+	source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", StopAtEnd: true})
+
+	var got []Message
+	assert.NoError(source.Consume(context.Background(), func(m Message) error {
+		got = append(got, m)
+		return nil
+	}))
+	require.Equal(4, len(got))
+	for i, m := range got {
+		assert.Equal([]byte{byte(i + 1)}, m.Data)
+	}
+	// the first three messages were written together, so share a batch.
+	assert.Equal(0, got[2].Sequence)
+	assert.Equal(1, got[3].Sequence)
+}
+
+func TestFlushBatch(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo"})
+	require.NoError(err)
+
+	assert.NoError(sink.PutMessages([][]byte{{1, 2, 3}, {4}}))
+	info, err := sink.FlushBatch()
+	require.NoError(err)
+	assert.Equal(&BatchInfo{Sequence: 0, Path: seqToPath("/foo", 0), Messages: 2, Bytes: 16, StoredBytes: 16}, info)
+
+	fi, err := ss.Stat(info.Path)
+	require.NoError(err)
+	assert.Equal(info.StoredBytes, fi.Size())
+
+	// there is nothing to flush.
+	info, err = sink.FlushBatch()
+	assert.NoError(err)
+	assert.Nil(info)
+	assert.NoError(sink.Close())
+
+	afs, err := NewMessageAutoFlushSink(ss, MessageSinkAutoFlushConfig{Path: "/foo", MaxUnflushedTime: 5 * time.Second})
+	require.NoError(err)
+	assert.NoError(afs.PutMessage([]byte{5}))
+	info, err = afs.FlushBatch()
+	require.NoError(err)
+	assert.Equal(1, info.Sequence)
+	assert.Equal(1, info.Messages)
+	assert.NoError(afs.Flush())
+	assert.NoError(afs.Close())
+}
+
+func TestOnFlush(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	var flushed []BatchInfo
+	sink, err := NewMessageAutoFlushSink(ss, MessageSinkAutoFlushConfig{
+		Path:                 "/foo",
+		MaxUnflushedTime:     5 * time.Second,
+		MaxUnflushedMessages: 2,
+		OnFlush: func(info BatchInfo) {
+			flushed = append(flushed, info)
+		},
+	})
+	require.NoError(err)
+
+	assert.NoError(sink.PutMessages([][]byte{{1}, {2}}))
+	assert.NoError(sink.PutMessage([]byte{3}))
+	assert.NoError(sink.Flush())
+	assert.NoError(sink.Flush())
+	assert.NoError(sink.PutMessage([]byte{4}))
+	assert.NoError(sink.Close())
+
+	require.Equal(3, len(flushed))
+	for i, info := range flushed {
+		assert.Equal(i, info.Sequence)
+	}
+	assert.Equal(2, flushed[0].Messages)
+	assert.Equal(1, flushed[1].Messages)
+	assert.Equal(1, flushed[2].Messages)
+}
+
+func TestSinkContextAndSealTimeout(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	mem, _ := straw.Open("mem://")
+	release := make(chan struct{})
+	defer close(release)
+	ss := &hangingCloseStore{mem, release}
+
+	sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo"})
+	require.NoError(err)
+	assert.NoError(sink.PutMessageContext(context.Background(), []byte{1}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, sink.CloseContext(ctx))
+
+	sink, err = NewMessageSink(ss, MessageSinkConfig{Path: "/bar", SealTimeout: 10 * time.Millisecond})
+	require.NoError(err)
+	assert.NoError(sink.PutMessage([]byte{1}))
+	assert.Equal(ErrSealTimeout, sink.Flush())
+	assert.Equal(ErrSealTimeout, sink.PutMessage([]byte{2}))
+}
+
+// hangingCloseStore is a store whose writers do not close until released.
+type hangingCloseStore struct {
+	straw.StreamStore
+	release chan struct{}
+}
+
+func (fs *hangingCloseStore) CreateWriteCloser(name string) (straw.StrawWriter, error) {
+	wc, err := fs.StreamStore.CreateWriteCloser(name)
+	if err != nil {
+		return nil, err
+	}
+	return &hangingCloseWriter{wc, fs.release}, nil
+}
+
+type hangingCloseWriter struct {
+	straw.StrawWriter
+	release chan struct{}
+}
+
+func (w *hangingCloseWriter) Close() error {
+	<-w.release
+	return w.StrawWriter.Close()
+}
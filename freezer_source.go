@@ -2,10 +2,8 @@ package freezer
 
 import (
 	"context"
-	"encoding/binary"
 	"fmt"
 	"io"
-	"os"
 	"time"
 
 	"github.com/uw-labs/straw"
@@ -13,113 +11,218 @@ import (
 
 type ConsumerMessageHandler func([]byte) error
 
+// Message is a message read from a stream, along with its position.
+type Message struct {
+	// Data is the message payload.
+	Data []byte
+	// Sequence is the sequence number of the batch containing the message.
+	Sequence int
+	// Index is the position of the message within its batch, starting at 0.
+	Index int
+	// Path is the path of the batch file containing the message.
+	Path string
+	// Offset is the byte offset of the message record within the
+	// uncompressed batch file.
+	Offset int64
+}
+
+// MessageHandler is a handler that receives messages along with their position.
+type MessageHandler func(Message) error
+
 type MessageSource struct {
+	store       straw.StreamStore
 	streamstore straw.StreamStore
 	path        string
+	consumerID  string
 	pollPeriod  time.Duration
+	startSeq    int
+	startIndex  int
+	stopAtEnd   bool
+	endSeq      int
+	prefetch    int
+
+	staleTimeout     time.Duration
+	staleBatchPolicy StaleBatchPolicy
+	onStaleBatch     func(*StaleBatchError) error
+
+	prunedBatchPolicy PrunedBatchPolicy
+
+	verifier Verifier
+
+	// err is an error in the source's configuration, which is returned
+	// when it is used.
+	err error
 }
 
 type MessageSourceConfig struct {
 	Path            string
 	PollPeriod      time.Duration
 	CompressionType CompressionType
+
+	// StartSequence is the sequence number of the batch to start consuming from.
+	StartSequence int
+	// StartIndex is the number of messages to skip within the first batch.
+	StartIndex int
+
+	// ConsumerID, if set, names a durable checkpoint stored alongside the
+	// stream. Consumption resumes from the checkpoint when one exists,
+	// taking precedence over StartSequence and StartIndex, and the
+	// checkpoint is updated after each batch and when consumption stops.
+	ConsumerID string
+
+	// StopAtEnd makes consumption return once the batch before EndSequence
+	// has been consumed, rather than waiting for new batches forever.
+	StopAtEnd bool
+	// EndSequence is the sequence number at which consumption stops when
+	// StopAtEnd is set. If zero, it is the sequence following the last
+	// complete batch at the time consumption starts. It is exclusive, so
+	// an EndSequence of 1 stops after batch 0. Because zero means the end
+	// of the stream, a replay that stops before batch 0, and so would be
+	// empty, cannot be requested.
+	EndSequence int
+
+	// Prefetch is the number of upcoming batch files to read ahead in the
+	// background while the current one is consumed. Prefetched batches are
+	// held in memory in full, so at most this many are buffered at a time.
+	// The last batch in the stream is never prefetched, as it may still be
+	// being written.
+	Prefetch int
+
+	// StaleBatchTimeout, if set, is how long a batch without an end marker
+	// may go without growing, while a later batch exists, before it is
+	// considered abandoned by its writer. By default, the source waits for
+	// such a batch to be completed forever. When it is set, a batch that
+	// ends part way through a message, or that cannot be decompressed, is
+	// treated in the same way, rather than failing straight away, as its
+	// writer may have crashed while writing it.
+	StaleBatchTimeout time.Duration
+	// StaleBatchPolicy determines what happens when a batch is abandoned.
+	StaleBatchPolicy StaleBatchPolicy
+	// OnStaleBatch, if set, is called when a batch is abandoned, and takes
+	// the place of StaleBatchPolicy. Returning nil skips the rest of the
+	// batch, while returning an error stops consumption with that error.
+	OnStaleBatch func(*StaleBatchError) error
+
+	// PrunedBatchPolicy determines what happens when the batch to be read
+	// next has been removed by Retention, such as when starting from
+	// sequence 0 on a pruned stream.
+	PrunedBatchPolicy PrunedBatchPolicy
+
+	// Verifier, if set, checks the signature of each batch before any of
+	// its messages are delivered, failing with a *SignatureError if it is
+	// unsigned or altered. Signatures cover the stream path, so a signed
+	// stream must be read from the path it was written to. Each batch is
+	// read in full, and held in memory, before it is delivered, so messages
+	// are not delivered until their batch is sealed.
+	Verifier Verifier
 }
 
-func NewMessageSource(streamstore straw.StreamStore, config MessageSourceConfig) *MessageSource {
+// StaleBatchPolicy determines what a MessageSource does with a batch that was
+// abandoned by its writer before it was complete.
+type StaleBatchPolicy int
 
-	switch config.CompressionType {
-	case CompressionTypeNone:
-	case CompressionTypeSnappy:
-		streamstore = newSnappyStreamStore(streamstore)
-	case CompressionTypeZstd:
-		streamstore = newZstdStreamStore(streamstore)
-	}
+const (
+	// StaleBatchFail stops consumption with a *StaleBatchError.
+	StaleBatchFail StaleBatchPolicy = 0
+	// StaleBatchSkip skips the rest of the batch and carries on with the
+	// next one.
+	StaleBatchSkip StaleBatchPolicy = 1
+)
+
+// StaleBatchError is returned when a batch was abandoned by its writer before
+// it was complete.
+type StaleBatchError struct {
+	Sequence int
+	Path     string
+}
+
+func (e *StaleBatchError) Error() string {
+	return fmt.Sprintf("batch %v was abandoned before it was complete", e.Path)
+}
 
+// NewMessageSource returns a source for the stream at config.Path. Errors in
+// config, such as an unknown compression type, are returned when the source is
+// used, by NewReader and the consume methods.
+func NewMessageSource(streamstore straw.StreamStore, config MessageSourceConfig) *MessageSource {
 	ms := &MessageSource{
-		streamstore: streamstore,
+		store:       streamstore,
+		streamstore: newCompressionStreamStore(streamstore, config.Path, config.CompressionType, false),
 		path:        config.Path,
+		consumerID:  config.ConsumerID,
 		pollPeriod:  config.PollPeriod,
+		startSeq:    config.StartSequence,
+		startIndex:  config.StartIndex,
+		stopAtEnd:   config.StopAtEnd,
+		endSeq:      config.EndSequence,
+		prefetch:    config.Prefetch,
+
+		staleTimeout:     config.StaleBatchTimeout,
+		staleBatchPolicy: config.StaleBatchPolicy,
+		onStaleBatch:     config.OnStaleBatch,
+
+		prunedBatchPolicy: config.PrunedBatchPolicy,
+
+		verifier: config.Verifier,
 	}
 	if ms.pollPeriod == 0 {
 		ms.pollPeriod = 5 * time.Second
 	}
+	if _, err := codecFor(config.CompressionType); err != nil {
+		ms.err = err
+	}
 	return ms
 }
 
 func (mq *MessageSource) ConsumeMessages(ctx context.Context, handler ConsumerMessageHandler) error {
+	return mq.Consume(ctx, func(m Message) error {
+		return handler(m.Data)
+	})
+}
 
-	var err error
-	var rc io.ReadCloser
-
+// Consume is like ConsumeMessages, but passes each message to the handler
+// along with its position in the stream.
+func (mq *MessageSource) Consume(ctx context.Context, handler MessageHandler) (retErr error) {
+	r, err := mq.NewReader()
+	if err != nil {
+		return err
+	}
 	defer func() {
-		if rc != nil {
-			rc.Close()
+		if err := r.Close(); err != nil && retErr == nil {
+			retErr = err
 		}
 	}()
 
-	lenBytes := []byte{0, 0, 0, 0}
-
-	for seq := 0; ; seq++ {
-		fullname := seqToPath(mq.path, seq)
-
-	waitLoop:
-		for {
-			rc, err = mq.streamstore.OpenReadCloser(fullname)
-			if err == nil {
-				break waitLoop
-			}
-			if !os.IsNotExist(err) {
-				return err
-			}
-			t := time.NewTimer(mq.pollPeriod)
-			select {
-			case <-ctx.Done():
-				t.Stop()
-				if ctx.Err() == context.DeadlineExceeded || ctx.Err() == context.Canceled {
-					return nil
-				}
-				return ctx.Err()
-			case <-t.C:
-			}
-		}
-	readLoop:
-		for {
-			_, err := io.ReadFull(rc, lenBytes[:])
-			if err != nil {
-				if err == io.EOF {
-					// file is likely still being written to, sleep and retry.
-					select {
-					case <-ctx.Done():
-						if ctx.Err() == context.DeadlineExceeded || ctx.Err() == context.Canceled {
-							return nil
-						}
-						return ctx.Err()
-					case <-time.After(mq.pollPeriod):
-						continue readLoop
-					}
-				}
-				return fmt.Errorf("Could not read length (%v)", err)
-			}
-
-			len := int(binary.LittleEndian.Uint32(lenBytes[:]))
-			if len == 0 {
-				// next read should be EOF
-				buf := []byte{0}
-				if _, err := rc.Read(buf); err != io.EOF {
-					return fmt.Errorf("Was able to read past end marker. This is broken, bailing out.")
-				}
-				break readLoop
-			}
-			buf := make([]byte, len)
-			if _, err := io.ReadFull(rc, buf); err != nil {
-				return fmt.Errorf("Could not read payload from %v. Expected len was %d. (%v)", fullname, len, err)
-			}
-			if err := handler(buf); err != nil {
-				return err
-			}
+	for {
+		m, err := r.Next(ctx)
+		switch {
+		case err == io.EOF:
+			return nil
+		case err == context.DeadlineExceeded || err == context.Canceled:
+			return nil
+		case err != nil:
+			return err
 		}
-		if err := rc.Close(); err != nil {
+		if err := handler(m); err != nil {
+			// the message was not consumed, so must not be checkpointed.
+			r.pos = Checkpoint{Sequence: m.Sequence, Index: m.Index}
 			return err
 		}
 	}
 }
+
+// endOfStream returns the sequence number following the last complete batch
+// in the stream.
+func (mq *MessageSource) endOfStream() (int, error) {
+	next, err := nextSequence(mq.store, mq.path)
+	if err != nil || next == 0 {
+		return next, err
+	}
+	complete, err := scanBatch(mq.streamstore, seqToPath(mq.path, next-1), nil)
+	if err != nil {
+		return -1, err
+	}
+	if !complete {
+		return next - 1, nil
+	}
+	return next, nil
+}
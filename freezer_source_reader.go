@@ -0,0 +1,415 @@
+package freezer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// MessageReader reads the messages of a stream one at a time. It is created
+// by MessageSource.NewReader and is not safe for concurrent use.
+type MessageReader struct {
+	mq *MessageSource
+
+	// pos is the position of the next message to be returned.
+	pos Checkpoint
+	end int
+
+	rc       io.ReadCloser
+	rr       *recordReader
+	prefetch *prefetcher
+	path     string
+	index    int
+	// size is the size of the open batch file, as stored, when it was
+	// opened, and checked is the offset at which rc last ran out of data
+	// after the file had grown beyond that. Some readers never see data
+	// written after they were opened, so rc is opened again if it runs out
+	// twice at the same offset while the file has grown.
+	size    int64
+	checked int64
+	// verify checks the signature of the open batch, if the source has a
+	// Verifier, until it has been read in full and verified.
+	verify *batchVerifier
+
+	// stalledSince is when the open batch was first found to have no more
+	// data, or zero if it has not.
+	stalledSince time.Time
+	// prunedChecked is when the low watermark was last checked while
+	// waiting for the batch at the current position to exist.
+	prunedChecked time.Time
+
+	// pending is a message that was read but not returned because the
+	// context was done.
+	pending *Message
+
+	closed bool
+}
+
+// NewReader returns a MessageReader positioned at the start position of the
+// source, or at its checkpoint if it has a ConsumerID.
+func (mq *MessageSource) NewReader() (*MessageReader, error) {
+	if mq.err != nil {
+		return nil, mq.err
+	}
+	r := &MessageReader{
+		mq:  mq,
+		pos: Checkpoint{Sequence: mq.startSeq, Index: mq.startIndex},
+		end: mq.endSeq,
+	}
+	if mq.consumerID != "" {
+		cp, err := ReadCheckpoint(mq.store, mq.path, mq.consumerID)
+		switch {
+		case err == nil:
+			r.pos = cp
+		case !os.IsNotExist(err):
+			return nil, err
+		}
+	}
+	if mq.stopAtEnd && r.end == 0 {
+		end, err := mq.endOfStream()
+		if err != nil {
+			return nil, err
+		}
+		r.end = end
+	}
+	return r, nil
+}
+
+// Next returns the next message in the stream, waiting for it to be written
+// if necessary. It returns io.EOF once the end of a bounded replay has been
+// reached, and the context's error if ctx is done first.
+func (r *MessageReader) Next(ctx context.Context) (Message, error) {
+	if r.closed {
+		return Message{}, errors.New("reader closed")
+	}
+	if r.pending != nil {
+		if err := ctx.Err(); err != nil {
+			return Message{}, err
+		}
+		m := *r.pending
+		r.pending = nil
+		r.pos.Index = m.Index + 1
+		return m, nil
+	}
+	for {
+		if r.rc == nil {
+			if r.mq.stopAtEnd && r.pos.Sequence >= r.end {
+				return Message{}, io.EOF
+			}
+			if err := r.open(ctx); err != nil {
+				return Message{}, err
+			}
+			if r.rc == nil {
+				// the position was moved past removed batches.
+				continue
+			}
+		}
+		m, ok, err := r.read(ctx)
+		if err != nil {
+			return Message{}, err
+		}
+		if !ok {
+			if err := r.nextBatch(); err != nil {
+				return Message{}, err
+			}
+			continue
+		}
+		if m.Index < r.pos.Index {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			// don't return any more messages once cancelled.
+			r.pending = &m
+			return Message{}, err
+		}
+		r.pos.Index = m.Index + 1
+		return m, nil
+	}
+}
+
+// Close releases the open batch file, if any, and stores the reader's
+// checkpoint if the source has a ConsumerID.
+func (r *MessageReader) Close() error {
+	if r.closed {
+		return errors.New("already closed")
+	}
+	r.closed = true
+	if r.rc != nil {
+		r.rc.Close()
+		r.rc = nil
+	}
+	if r.prefetch != nil {
+		r.prefetch.close()
+		r.prefetch = nil
+	}
+	if r.mq.consumerID != "" {
+		return writeCheckpoint(r.mq.store, r.mq.path, r.mq.consumerID, r.pos)
+	}
+	return nil
+}
+
+// open waits for the batch at the current position to exist and opens it. If
+// the batch has been removed by Retention, it applies the pruned batch policy
+// instead, leaving the batch unopened.
+func (r *MessageReader) open(ctx context.Context) error {
+	fullname := seqToPath(r.mq.path, r.pos.Sequence)
+	r.path = fullname
+	r.index = 0
+	r.checked = -1
+	r.verify = nil
+	if r.mq.verifier != nil {
+		r.verify = newBatchVerifier(r.mq.verifier, r.mq.path, r.pos.Sequence, fullname)
+	}
+	r.stalledSince = time.Time{}
+
+	if r.prefetch != nil {
+		b, ok, err := r.prefetch.next(ctx, r.pos.Sequence)
+		if err != nil {
+			return err
+		}
+		if ok {
+			r.rc = io.NopCloser(bytes.NewReader(b.data))
+			r.rr = &recordReader{r: r.rc, path: fullname}
+			r.size = b.size
+			return nil
+		}
+		r.prefetch.close()
+		r.prefetch = nil
+	}
+	for {
+		rc, size, err := r.openFile()
+		if err == nil {
+			r.rc = rc
+			r.rr = &recordReader{r: rc, path: fullname}
+			r.size = size
+			r.prunedChecked = time.Time{}
+			if r.mq.prefetch > 0 {
+				r.prefetch = newPrefetcher(r.mq.store, r.mq.streamstore, r.mq.path, r.pos.Sequence+1, r.mq.prefetch)
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		// a batch that does not exist has most likely not been written
+		// yet, so the watermark is only checked now and then.
+		if time.Since(r.prunedChecked) >= prunedCheckPeriod {
+			r.prunedChecked = time.Now()
+			pruned, err := r.pruned()
+			if err != nil || pruned {
+				return err
+			}
+		}
+		if err := r.wait(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// pruned applies the pruned batch policy if the batch at the current position
+// has been removed by Retention, and reports whether it has.
+func (r *MessageReader) pruned() (bool, error) {
+	wm, err := LowWatermark(r.mq.store, r.mq.path)
+	if err != nil || r.pos.Sequence >= wm {
+		return false, err
+	}
+	if r.mq.prunedBatchPolicy == PrunedBatchFail {
+		return false, &PrunedBatchError{Sequence: r.pos.Sequence, LowWatermark: wm}
+	}
+	r.pos = Checkpoint{Sequence: wm}
+	r.prunedChecked = time.Time{}
+	return true, nil
+}
+
+// read returns the next message of the open batch, or false if the end of the
+// batch has been reached.
+func (r *MessageReader) read(ctx context.Context) (Message, bool, error) {
+	for {
+		buf, ok, err := r.next()
+		if err == nil {
+			r.stalledSince = time.Time{}
+			if !ok {
+				return Message{}, false, nil
+			}
+			m := Message{Data: buf, Sequence: r.pos.Sequence, Index: r.index, Path: r.path, Offset: r.rr.last}
+			r.index++
+			return m, true, nil
+		}
+		// with stale batch detection, a batch that ends part way through
+		// a record, or through a compressed block, which some codecs
+		// report as corrupt, may still be being written, or may have
+		// been abandoned, so is treated like one that ends between
+		// records. The open batch has not been read to its end marker,
+		// so one that is too short to read, such as an encrypted batch
+		// that ends before its final chunk, is too.
+		partial := isTruncated(err) || isDecompressionError(err)
+		if err != io.EOF && !isIncomplete(err) && !(r.mq.staleTimeout > 0 && partial) {
+			return Message{}, false, err
+		}
+		reopened, err := r.refresh()
+		if err != nil {
+			return Message{}, false, err
+		}
+		if reopened {
+			continue
+		}
+		if r.mq.staleTimeout > 0 {
+			stale, err := r.stale()
+			if err != nil {
+				return Message{}, false, err
+			}
+			if stale {
+				return Message{}, false, r.abandon()
+			}
+		}
+		// file is likely still being written to, sleep and retry.
+		if err := r.wait(ctx); err != nil {
+			return Message{}, false, err
+		}
+	}
+}
+
+// next returns the next record of the open batch. If the source has a
+// Verifier, the whole batch is read and verified first, and io.EOF is returned
+// until it is complete.
+func (r *MessageReader) next() ([]byte, bool, error) {
+	if r.verify != nil {
+		data, readErr := io.ReadAll(r.rc)
+		complete, err := r.verify.add(data)
+		if err != nil {
+			return nil, false, err
+		}
+		if readErr != nil {
+			return nil, false, readErr
+		}
+		if !complete {
+			return nil, false, io.EOF
+		}
+		r.rr.r = bytes.NewReader(r.verify.data)
+		r.verify = nil
+	}
+	return r.rr.next()
+}
+
+// stale reports whether the open batch has not grown for the stale batch
+// timeout while a later batch exists, meaning that its writer has gone away.
+func (r *MessageReader) stale() (bool, error) {
+	now := time.Now()
+	if r.stalledSince.IsZero() {
+		r.stalledSince = now
+		return false, nil
+	}
+	if now.Sub(r.stalledSince) < r.mq.staleTimeout {
+		return false, nil
+	}
+	_, err := r.mq.store.Stat(seqToPath(r.mq.path, r.pos.Sequence+1))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// abandon applies the stale batch policy to the open batch. If it returns nil,
+// the rest of the batch is skipped.
+func (r *MessageReader) abandon() error {
+	e := &StaleBatchError{Sequence: r.pos.Sequence, Path: r.path}
+	if r.mq.onStaleBatch != nil {
+		return r.mq.onStaleBatch(e)
+	}
+	if r.mq.staleBatchPolicy == StaleBatchSkip {
+		return nil
+	}
+	return e
+}
+
+// openFile opens the batch file at the current position, returning its size as
+// stored when it was opened.
+func (r *MessageReader) openFile() (io.ReadCloser, int64, error) {
+	fi, err := r.mq.store.Stat(r.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	rc, err := r.mq.streamstore.OpenReadCloser(r.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rc, fi.Size(), nil
+}
+
+// refresh is called when the open batch has no more data. If the batch file
+// has grown since it was opened, but the reader has twice run out of data at
+// the same offset since, the reader cannot see the new data, so the batch is
+// reopened. It reports whether it was.
+func (r *MessageReader) refresh() (bool, error) {
+	fi, err := r.mq.store.Stat(r.path)
+	if err != nil || fi.Size() <= r.size {
+		return false, err
+	}
+	if r.consumed() != r.checked {
+		r.checked = r.consumed()
+		return false, nil
+	}
+	return true, r.reopen()
+}
+
+// consumed returns the number of bytes read from the open batch file.
+func (r *MessageReader) consumed() int64 {
+	if r.verify != nil {
+		return int64(len(r.verify.data))
+	}
+	return r.rr.consumed()
+}
+
+// reopen opens the current batch file again and skips to the current offset,
+// so that data written since it was opened can be read.
+func (r *MessageReader) reopen() error {
+	r.rc.Close()
+	rc, size, err := r.openFile()
+	if err != nil {
+		r.rc = nil
+		return err
+	}
+	r.rc = rc
+	r.size = size
+	r.checked = -1
+	// a batch being verified has not been read by rr yet.
+	offset := r.rr.offset
+	if r.verify != nil {
+		offset = r.consumed()
+	} else {
+		r.rr.reset(rc)
+	}
+	if _, err := io.CopyN(io.Discard, rc, offset); err != nil {
+		return fmt.Errorf("Could not skip to offset %d in %v (%v)", offset, r.path, err)
+	}
+	return nil
+}
+
+// nextBatch closes the finished batch and moves on to the following one.
+func (r *MessageReader) nextBatch() error {
+	err := r.rc.Close()
+	r.rc = nil
+	if err != nil {
+		return err
+	}
+	r.pos = Checkpoint{Sequence: r.pos.Sequence + 1}
+	if r.mq.consumerID != "" {
+		return writeCheckpoint(r.mq.store, r.mq.path, r.mq.consumerID, r.pos)
+	}
+	return nil
+}
+
+func (r *MessageReader) wait(ctx context.Context) error {
+	t := time.NewTimer(r.mq.pollPeriod)
+	select {
+	case <-ctx.Done():
+		t.Stop()
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
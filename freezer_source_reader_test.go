@@ -0,0 +1,116 @@
+package freezer
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+)
+
+func TestReaderNext(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo"})
+	require.NoError(err)
+	assert.NoError(sink.PutMessage([]byte{1}))
+	assert.NoError(sink.Flush())
+	assert.NoError(sink.PutMessage([]byte{2}))
+
+	source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", PollPeriod: 10 * time.Millisecond})
+	r, err := source.NewReader()
+	require.NoError(err)
+
+	m, err := r.Next(context.Background())
+	require.NoError(err)
+	assert.Equal([]byte{1}, m.Data)
+
+	m, err = r.Next(context.Background())
+	require.NoError(err)
+	assert.Equal([]byte{2}, m.Data)
+
+	// the batch is still open, so the reader waits for more.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	_, err = r.Next(ctx)
+	assert.Equal(context.DeadlineExceeded, err)
+
+	assert.NoError(sink.Close())
+
+	ctx, cancel = context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	_, err = r.Next(ctx)
+	assert.Equal(context.DeadlineExceeded, err)
+
+	assert.NoError(r.Close())
+	_, err = r.Next(context.Background())
+	assert.EqualError(err, "reader closed")
+}
+
+func TestReaderStopAtEnd(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo"})
+	require.NoError(err)
+	assert.NoError(sink.PutMessage([]byte{1}))
+	assert.NoError(sink.Close())
+
+	source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", StopAtEnd: true})
+	r, err := source.NewReader()
+	require.NoError(err)
+	defer r.Close()
+
+	m, err := r.Next(context.Background())
+	require.NoError(err)
+	assert.Equal(Message{Data: []byte{1}, Path: "/foo/00/00/00/00/00/00/00"}, m)
+
+	_, err = r.Next(context.Background())
+	assert.Equal(io.EOF, err)
+}
+
+func TestReaderChecksWatermarkWhileWaiting(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	mem, _ := straw.Open("mem://")
+	ss := &openCountingStore{StreamStore: mem, path: metaPath("/foo")}
+	writeBatches(t, ss, "/foo", 1)
+
+	source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", PollPeriod: 5 * time.Millisecond})
+	r, err := source.NewReader()
+	require.NoError(err)
+	defer r.Close()
+
+	_, err = r.Next(context.Background())
+	require.NoError(err)
+
+	// waiting for the next batch does not read the watermark on every poll.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = r.Next(ctx)
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.Equal(1, ss.opens)
+}
+
+// openCountingStore counts the times the file at path is opened.
+type openCountingStore struct {
+	straw.StreamStore
+	path  string
+	opens int
+}
+
+func (fs *openCountingStore) OpenReadCloser(name string) (straw.StrawReader, error) {
+	if name == fs.path {
+		fs.opens++
+	}
+	return fs.StreamStore.OpenReadCloser(name)
+}
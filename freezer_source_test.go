@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/golang/snappy"
 	"github.com/stretchr/testify/assert"
 	"github.com/uw-labs/straw"
 )
@@ -142,6 +144,239 @@ func TestSourceContextCancelDuringRead(t *testing.T) {
 
 }
 
+func TestConsumeFromStartPosition(t *testing.T) {
+	assert := assert.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for b := byte(0); b < 3; b++ {
+		assert.NoError(sink.PutMessage([]byte{b, 0}))
+		assert.NoError(sink.PutMessage([]byte{b, 1}))
+		assert.NoError(sink.Flush())
+	}
+	assert.NoError(sink.Close())
+
+	source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", PollPeriod: 10 * time.Millisecond, StartSequence: 1, StartIndex: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*1)
+	defer cancel()
+
+	var got [][]byte
+	err = source.ConsumeMessages(ctx, func(m []byte) error {
+		got = append(got, m)
+		if len(got) == 3 {
+			cancel()
+		}
+		return nil
+	})
+	assert.NoError(err)
+	assert.Equal([][]byte{{1, 1}, {2, 0}, {2, 1}}, got)
+}
+
+func TestConsumeMessageMetadata(t *testing.T) {
+	assert := assert.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(sink.PutMessage([]byte{1}))
+	assert.NoError(sink.Flush())
+	assert.NoError(sink.PutMessage([]byte{2, 2}))
+	assert.NoError(sink.PutMessage([]byte{3}))
+	assert.NoError(sink.Close())
+
+	source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", PollPeriod: 10 * time.Millisecond})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*1)
+	defer cancel()
+
+	var got []Message
+	err = source.Consume(ctx, func(m Message) error {
+		got = append(got, m)
+		if len(got) == 3 {
+			cancel()
+		}
+		return nil
+	})
+	assert.NoError(err)
+	assert.Equal([]Message{
+		{Data: []byte{1}, Sequence: 0, Index: 0, Path: "/foo/00/00/00/00/00/00/00", Offset: 0},
+		{Data: []byte{2, 2}, Sequence: 1, Index: 0, Path: "/foo/00/00/00/00/00/00/01", Offset: 0},
+		{Data: []byte{3}, Sequence: 1, Index: 1, Path: "/foo/00/00/00/00/00/00/01", Offset: 6},
+	}, got)
+}
+
+func TestConsumeStopAtEnd(t *testing.T) {
+	assert := assert.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	for b := byte(0); b < 2; b++ {
+		assert.NoError(sink.PutMessage([]byte{b}))
+		assert.NoError(sink.Flush())
+	}
+	// this batch is still being written, so is not part of the replay.
+	assert.NoError(sink.PutMessage([]byte{2}))
+
+	tests := []struct {
+		name     string
+		end      int
+		expected [][]byte
+	}{
+		{"Explicit end", 1, [][]byte{{0}}},
+		{"End of stream", 0, [][]byte{{0}, {1}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", PollPeriod: 10 * time.Millisecond, StopAtEnd: true, EndSequence: test.end})
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*1)
+			defer cancel()
+
+			got, err := consumeAll(ctx, source)
+			assert.NoError(err)
+			assert.NoError(ctx.Err())
+			assert.Equal(test.expected, got)
+		})
+	}
+}
+
+func TestStaleBatch(t *testing.T) {
+	abandoned := errors.New("abandoned")
+	unterminated := append(length(1), 1)
+	// the writer crashed part way through writing the second message.
+	midRecord := append(append(length(1), 1), append(length(5), 9, 9)...)
+
+	tests := []struct {
+		name     string
+		batch    []byte
+		policy   StaleBatchPolicy
+		callback func(*StaleBatchError) error
+		expected [][]byte
+		err      error
+	}{
+		{"Skip", unterminated, StaleBatchSkip, nil, [][]byte{{1}, {2}}, nil},
+		{"Fail", unterminated, StaleBatchFail, nil, [][]byte{{1}}, &StaleBatchError{Sequence: 0, Path: "/foo/00/00/00/00/00/00/00"}},
+		{"Callback", unterminated, StaleBatchSkip, func(*StaleBatchError) error { return abandoned }, [][]byte{{1}}, abandoned},
+		{"Skip mid-record", midRecord, StaleBatchSkip, nil, [][]byte{{1}, {2}}, nil},
+		{"Fail mid-record", midRecord, StaleBatchFail, nil, [][]byte{{1}}, &StaleBatchError{Sequence: 0, Path: "/foo/00/00/00/00/00/00/00"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			ss, _ := straw.Open("mem://")
+			writeFile(t, ss, seqToPath("/foo", 0), test.batch)
+			writeFile(t, ss, seqToPath("/foo", 1), append(append(length(1), 2), delim...))
+
+			source := NewMessageSource(ss, MessageSourceConfig{
+				Path:              "/foo",
+				PollPeriod:        5 * time.Millisecond,
+				StopAtEnd:         true,
+				EndSequence:       2,
+				StaleBatchTimeout: 20 * time.Millisecond,
+				StaleBatchPolicy:  test.policy,
+				OnStaleBatch:      test.callback,
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*1)
+			defer cancel()
+
+			got, err := consumeAll(ctx, source)
+			assert.Equal(test.err, err)
+			assert.NoError(ctx.Err())
+			assert.Equal(test.expected, got)
+		})
+	}
+}
+
+func TestStaleCompressedBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	// the first batch ends part way through its second snappy block, which
+	// snappy reports as corrupt.
+	var buf bytes.Buffer
+	w := snappy.NewBufferedWriter(&buf)
+	assert.NoError(writeRecord(w, 0, []byte{1}))
+	assert.NoError(w.Flush())
+	assert.NoError(writeRecord(w, 0, []byte{2}))
+	assert.NoError(w.Close())
+
+	ss, _ := straw.Open("mem://")
+	writeFile(t, ss, seqToPath("/foo", 0), buf.Bytes()[:buf.Len()-2])
+	sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo", CompressionType: CompressionTypeSnappy})
+	assert.NoError(err)
+	assert.NoError(sink.PutMessage([]byte{3}))
+	assert.NoError(sink.Close())
+
+	source := NewMessageSource(ss, MessageSourceConfig{
+		Path:              "/foo",
+		CompressionType:   CompressionTypeSnappy,
+		PollPeriod:        5 * time.Millisecond,
+		StopAtEnd:         true,
+		EndSequence:       2,
+		StaleBatchTimeout: 20 * time.Millisecond,
+		StaleBatchPolicy:  StaleBatchSkip,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*1)
+	defer cancel()
+
+	got, err := consumeAll(ctx, source)
+	assert.NoError(err)
+	assert.NoError(ctx.Err())
+	assert.Equal([][]byte{{1}, {3}}, got)
+}
+
+func TestPrunedBatches(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   PrunedBatchPolicy
+		expected [][]byte
+		err      error
+	}{
+		{"Skip", PrunedBatchSkip, [][]byte{{3}, {4}}, nil},
+		{"Fail", PrunedBatchFail, nil, &PrunedBatchError{Sequence: 0, LowWatermark: 3}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			ss, _ := straw.Open("mem://")
+			writeBatches(t, ss, "/foo", 5)
+			_, err := NewRetention(ss, RetentionConfig{Path: "/foo", MaxCount: 2}).Prune()
+			assert.NoError(err)
+
+			source := NewMessageSource(ss, MessageSourceConfig{
+				Path:              "/foo",
+				PollPeriod:        5 * time.Millisecond,
+				StopAtEnd:         true,
+				PrunedBatchPolicy: test.policy,
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*1)
+			defer cancel()
+
+			got, err := consumeAll(ctx, source)
+			assert.Equal(test.err, err)
+			assert.NoError(ctx.Err())
+			assert.Equal(test.expected, got)
+		})
+	}
+}
+
 func length(l int) []byte {
 	var lenBytes [4]byte
 	binary.LittleEndian.PutUint32(lenBytes[:], uint32(l))
@@ -188,8 +423,7 @@ func (fs mockStrawStore) Lstat(path string) (os.FileInfo, error) {
 
 }
 func (fs mockStrawStore) Stat(path string) (os.FileInfo, error) {
-	return nil, nil
-
+	return mockFileInfo{int64(len(fs.d))}, nil
 }
 func (fs mockStrawStore) Readdir(path string) ([]os.FileInfo, error) {
 	return nil, nil
@@ -205,3 +439,14 @@ func (fs mockStrawStore) Remove(path string) error {
 func (fs mockStrawStore) Close() error {
 	return nil
 }
+
+type mockFileInfo struct {
+	size int64
+}
+
+func (fi mockFileInfo) Name() string       { return "" }
+func (fi mockFileInfo) Size() int64        { return fi.size }
+func (fi mockFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi mockFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi mockFileInfo) IsDir() bool        { return false }
+func (fi mockFileInfo) Sys() interface{}   { return nil }
@@ -40,3 +40,14 @@ func TestSimpleHappyPathRoundTrip(t *testing.T) {
 	}
 
 }
+
+// consumeAll consumes messages from source until consumption stops, returning
+// them along with the error it stopped with.
+func consumeAll(ctx context.Context, source *MessageSource) ([][]byte, error) {
+	var got [][]byte
+	err := source.ConsumeMessages(ctx, func(m []byte) error {
+		got = append(got, m)
+		return nil
+	})
+	return got, err
+}
@@ -0,0 +1,65 @@
+package freezer
+
+import (
+	"context"
+	"sync"
+)
+
+// PutFuture is the result of an asynchronous put. It is resolved once the
+// batch containing the messages has been sealed, at which point they are
+// durably stored, or once writing them has failed.
+type PutFuture struct {
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+func newPutFuture() *PutFuture {
+	return &PutFuture{done: make(chan struct{})}
+}
+
+func (f *PutFuture) resolve(err error) {
+	f.once.Do(func() {
+		f.err = err
+		close(f.done)
+	})
+}
+
+// Done returns a channel that is closed when the future is resolved.
+func (f *PutFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait waits for the future to be resolved. It returns nil if the messages
+// were durably stored, or the error that prevented it.
+func (f *PutFuture) Wait() error {
+	<-f.done
+	return f.err
+}
+
+// WaitContext is like Wait, but returns ctx's error if ctx is done before the
+// future is resolved.
+func (f *PutFuture) WaitContext(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// copyMessages copies messages that are written after the caller has returned,
+// so that the caller can reuse them straight away.
+func copyMessages(ms [][]byte) [][]byte {
+	n := 0
+	for _, m := range ms {
+		n += len(m)
+	}
+	buf := make([]byte, 0, n)
+	cp := make([][]byte, len(ms))
+	for i, m := range ms {
+		buf = append(buf, m...)
+		cp[i] = buf[len(buf)-len(m):]
+	}
+	return cp
+}
@@ -0,0 +1,87 @@
+package freezer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+)
+
+func TestPutMessageAsync(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo"})
+	require.NoError(err)
+
+	f1 := sink.PutMessageAsync([]byte{1})
+	f2 := sink.PutMessagesAsync([][]byte{{2}, {3}})
+
+	// the batch is not sealed until it is flushed.
+	select {
+	case <-f1.Done():
+		t.Fatal("future resolved before flush")
+	case <-f2.Done():
+		t.Fatal("future resolved before flush")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	assert.NoError(sink.Flush())
+	assert.NoError(f1.Wait())
+	assert.NoError(f2.Wait())
+
+	f3 := sink.PutMessageAsync([]byte{4})
+	assert.NoError(sink.Close())
+	assert.NoError(f3.Wait())
+
+	assert.EqualError(sink.PutMessageAsync([]byte{5}).Wait(), "already closed")
+}
+
+func TestAutoFlushPutMessageAsync(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	sink, err := NewMessageAutoFlushSink(ss, MessageSinkAutoFlushConfig{Path: "/foo", MaxUnflushedTime: 5 * time.Millisecond})
+	require.NoError(err)
+	defer sink.Close()
+
+	f := sink.PutMessageAsync([]byte{1})
+	select {
+	case <-f.Done():
+		assert.NoError(f.Wait())
+	case <-time.After(time.Second):
+		t.Fatal("timeout before batch was sealed")
+	}
+}
+
+func TestPutMessageAsyncCopiesMessages(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo"})
+	require.NoError(err)
+
+	// the buffer is reused straight away, as it would be with PutMessage.
+	buf := []byte{1}
+	f1 := sink.PutMessageAsync(buf)
+	buf[0] = 2
+	f2 := sink.PutMessagesAsync([][]byte{buf})
+	buf[0] = 3
+	assert.NoError(sink.Close())
+	assert.NoError(f1.Wait())
+	assert.NoError(f2.Wait())
+
+	source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", StopAtEnd: true})
+	got, err := consumeAll(context.Background(), source)
+	assert.NoError(err)
+	assert.Equal([][]byte{{1}, {2}}, got)
+}
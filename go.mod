@@ -4,7 +4,7 @@ go 1.18
 
 require (
 	github.com/golang/snappy v0.0.4
-	github.com/klauspost/compress v1.15.1
+	github.com/klauspost/compress v1.17.0
 	github.com/stretchr/testify v1.7.1
 	github.com/uw-labs/straw v0.0.0-20220413125153-9e7a44bbbfda
 )
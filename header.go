@@ -0,0 +1,94 @@
+package freezer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A batch file may start with a header that identifies how the rest of the
+// file is encoded, so that it can be read without configuration. The header
+// is the magic bytes, a header version byte and the compression type byte.
+// Version 2 headers follow these with the ID of the zstd dictionary the file
+// was compressed with, as 4 little endian bytes. The header is not itself
+// compressed. Files without a header are read using the compression type
+// configured on the source. A file that is too short to tell whether it has a
+// header cannot be read until more of it has been written.
+
+var headerMagic = []byte{0x89, 'F', 'R', 'Z'}
+
+// errIncompleteHeader is returned when reading a file that is too short to
+// tell whether it has a header.
+var errIncompleteHeader error = &incompleteError{msg: "file is too short to read its header"}
+
+const (
+	headerVersion     = 1
+	headerVersionDict = 2
+	headerLen         = 6
+	headerLenDict     = 10
+)
+
+// fileHeader is the decoded header of a batch file.
+type fileHeader struct {
+	compressionType CompressionType
+	// dictID is the ID of the zstd dictionary, or 0 if there is none.
+	dictID uint32
+}
+
+func writeHeader(w io.Writer, h fileHeader) error {
+	var header [headerLenDict]byte
+	copy(header[:], headerMagic)
+	header[4] = headerVersion
+	header[5] = byte(h.compressionType)
+	n := headerLen
+	if h.dictID != 0 {
+		header[4] = headerVersionDict
+		binary.LittleEndian.PutUint32(header[6:], h.dictID)
+		n = headerLenDict
+	}
+	_, err := w.Write(header[:n])
+	return err
+}
+
+// readHeader reads the header from br, if it has one. It returns
+// errIncompleteHeader if br ends before it can tell.
+func readHeader(br *bufio.Reader) (fileHeader, bool, error) {
+	var h fileHeader
+	magic, err := br.Peek(len(headerMagic))
+	if err != nil && err != io.EOF {
+		return h, false, err
+	}
+	if !bytes.HasPrefix(headerMagic, magic) {
+		return h, false, nil
+	}
+	if len(magic) < len(headerMagic) {
+		// probably still being written.
+		return h, false, errIncompleteHeader
+	}
+	var header [headerLenDict]byte
+	if err := readFullHeader(br, header[:headerLen]); err != nil {
+		return h, false, err
+	}
+	h.compressionType = CompressionType(header[5])
+	switch header[4] {
+	case headerVersion:
+	case headerVersionDict:
+		if err := readFullHeader(br, header[headerLen:]); err != nil {
+			return h, false, err
+		}
+		h.dictID = binary.LittleEndian.Uint32(header[6:])
+	default:
+		return h, false, fmt.Errorf("unsupported header version %d", header[4])
+	}
+	return h, true, nil
+}
+
+func readFullHeader(br *bufio.Reader, buf []byte) error {
+	_, err := io.ReadFull(br, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errIncompleteHeader
+	}
+	return err
+}
@@ -0,0 +1,108 @@
+package freezer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+)
+
+func TestHeaderCompressionDetection(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	for i, config := range []MessageSinkConfig{
+		{Path: "/foo", CompressionType: CompressionTypeSnappy, WriteHeader: true},
+		{Path: "/foo", CompressionType: CompressionTypeZstd, WriteHeader: true},
+		{Path: "/foo", CompressionType: CompressionTypeSnappy},
+	} {
+		sink, err := NewMessageSink(ss, config)
+		require.NoError(err)
+		assert.NoError(sink.PutMessage([]byte{byte(i)}))
+		assert.NoError(sink.Close())
+	}
+
+	// the last batch has no header, so is read with the configured
+	// compression type.
+	source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", CompressionType: CompressionTypeSnappy, StopAtEnd: true})
+
+	got, err := consumeAll(context.Background(), source)
+	assert.NoError(err)
+	assert.Equal([][]byte{{0}, {1}, {2}}, got)
+}
+
+func TestUnsupportedHeader(t *testing.T) {
+	assert := assert.New(t)
+
+	ss := newMockStrawStore(append(append([]byte{}, headerMagic...), 3, 0))
+	source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo"})
+
+	err := source.ConsumeMessages(context.Background(), func([]byte) error { return nil })
+	assert.EqualError(err, "could not read header of /foo/00/00/00/00/00/00/00 (unsupported header version 3)")
+}
+
+func TestReadHeaderIncomplete(t *testing.T) {
+	magic := func(b ...byte) []byte {
+		return append(append([]byte{}, headerMagic...), b...)
+	}
+	tests := []struct {
+		name   string
+		data   []byte
+		header bool
+		err    error
+	}{
+		{"Empty", nil, false, errIncompleteHeader},
+		{"Partial magic", headerMagic[:2], false, errIncompleteHeader},
+		{"Magic", magic(), false, errIncompleteHeader},
+		{"Partial dictionary ID", magic(headerVersionDict, byte(CompressionTypeZstd), 1), false, errIncompleteHeader},
+		{"Header", magic(headerVersion, byte(CompressionTypeSnappy)), true, nil},
+		{"No header", []byte{0, 0, 0, 0}, false, nil},
+		{"Short, no header", []byte{1}, false, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, ok, err := readHeader(bufio.NewReader(bytes.NewReader(test.data)))
+			assert.Equal(t, test.err, err)
+			assert.Equal(t, test.header, ok)
+		})
+	}
+}
+
+func TestReaderWaitsForHeader(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	// the batch has been created, but its header has only been written in
+	// part.
+	writeFile(t, ss, seqToPath("/foo", 0), headerMagic[:2])
+
+	source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", PollPeriod: 5 * time.Millisecond})
+	r, err := source.NewReader()
+	require.NoError(err)
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	_, err = r.Next(ctx)
+	assert.Equal(context.DeadlineExceeded, err)
+
+	var batch bytes.Buffer
+	require.NoError(writeHeader(&batch, fileHeader{compressionType: CompressionTypeNone}))
+	require.NoError(writeRecord(&batch, 0, []byte{1}))
+	writeFile(t, ss, seqToPath("/foo", 0), batch.Bytes())
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	m, err := r.Next(ctx)
+	require.NoError(err)
+	assert.Equal([]byte{1}, m.Data)
+}
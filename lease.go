@@ -0,0 +1,148 @@
+package freezer
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/uw-labs/straw"
+)
+
+// FencingPolicy determines how a sink guards against other sinks writing to
+// the same stream. Sinks with fencing take a lease on the stream, stored in
+// its directory, which is renewed each time they start or seal a batch. The
+// lease has an epoch that is increased by each sink that takes it, and a sink
+// that finds the epoch has changed stops with ErrFenced, without sealing its
+// current batch or writing any more.
+//
+// straw stores do not support conditional writes, so sinks starting at the
+// same moment may both believe they hold the lease. Fencing protects against
+// stale and misconfigured writers, not against races between new ones.
+type FencingPolicy int
+
+const (
+	// FencingNone disables fencing.
+	FencingNone FencingPolicy = 0
+	// FencingFailFast makes NewMessageSink fail with ErrLeaseHeld if
+	// another sink holds an unexpired lease on the stream.
+	FencingFailFast FencingPolicy = 1
+	// FencingTakeover makes NewMessageSink take the lease whether or not
+	// another sink holds it, fencing that sink off.
+	FencingTakeover FencingPolicy = 2
+)
+
+const (
+	DefaultLeaseTTL = time.Minute
+)
+
+var (
+	// ErrLeaseHeld is returned when creating a sink for a stream that is
+	// leased by another sink.
+	ErrLeaseHeld = errors.New("stream is leased by another sink")
+	// ErrFenced is returned by a sink whose lease was taken by another
+	// sink. The sink cannot be used after this.
+	ErrFenced = errors.New("sink was fenced off by another sink")
+)
+
+const leaseFile = ".lease"
+
+type lease struct {
+	Epoch    int64     `json:"epoch"`
+	Renewed  time.Time `json:"renewed"`
+	Released bool      `json:"released"`
+}
+
+func leasePath(basepath string) string {
+	return filepath.Join(basepath, leaseFile)
+}
+
+func readLease(ss straw.StreamStore, basepath string) (lease, error) {
+	var l lease
+	rc, err := ss.OpenReadCloser(leasePath(basepath))
+	if err != nil {
+		return l, err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return l, err
+	}
+	err = json.Unmarshal(data, &l)
+	return l, err
+}
+
+func writeLease(ss straw.StreamStore, basepath string, l lease) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	wc, err := ss.CreateWriteCloser(leasePath(basepath))
+	if err != nil {
+		return err
+	}
+	if _, err := wc.Write(data); err != nil {
+		_ = wc.Close()
+		return err
+	}
+	return wc.Close()
+}
+
+// acquireLease takes the lease on the stream according to the sink's fencing
+// policy.
+func (mq *MessageSink) acquireLease() error {
+	current, err := readLease(mq.store, mq.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	switch mq.fencing {
+	case FencingFailFast:
+		if err == nil && !current.Released && time.Since(current.Renewed) < mq.leaseTTL {
+			return ErrLeaseHeld
+		}
+	case FencingTakeover:
+	default:
+		return errors.New("unknown fencing policy")
+	}
+
+	mq.epoch = current.Epoch + 1
+	if err := writeLease(mq.store, mq.path, lease{Epoch: mq.epoch, Renewed: time.Now()}); err != nil {
+		return err
+	}
+	return mq.renewLease()
+}
+
+// renewLease checks that the sink still holds its lease, and extends it.
+func (mq *MessageSink) renewLease() error {
+	current, err := readLease(mq.store, mq.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrFenced
+		}
+		return err
+	}
+	if current.Epoch != mq.epoch {
+		return ErrFenced
+	}
+	return writeLease(mq.store, mq.path, lease{Epoch: mq.epoch, Renewed: time.Now()})
+}
+
+// releaseLease gives up the sink's lease, if it still holds it, so that other
+// sinks can take it straight away.
+func (mq *MessageSink) releaseLease() error {
+	current, err := readLease(mq.store, mq.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if current.Epoch != mq.epoch {
+		return nil
+	}
+	return writeLease(mq.store, mq.path, lease{Epoch: mq.epoch, Renewed: current.Renewed, Released: true})
+}
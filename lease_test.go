@@ -0,0 +1,107 @@
+package freezer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+)
+
+func TestFencingFailFast(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo", Fencing: FencingFailFast})
+	require.NoError(err)
+
+	_, err = NewMessageSink(ss, MessageSinkConfig{Path: "/foo", Fencing: FencingFailFast})
+	assert.Equal(ErrLeaseHeld, err)
+
+	assert.NoError(sink.PutMessage([]byte{1}))
+	assert.NoError(sink.Close())
+
+	// the lease was released on close.
+	sink, err = NewMessageSink(ss, MessageSinkConfig{Path: "/foo", Fencing: FencingFailFast})
+	require.NoError(err)
+	assert.NoError(sink.Close())
+
+	l, err := readLease(ss, "/foo")
+	require.NoError(err)
+	assert.Equal(int64(2), l.Epoch)
+	assert.True(l.Released)
+}
+
+func TestFencingTakeover(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	stale, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo", Fencing: FencingTakeover})
+	require.NoError(err)
+	assert.NoError(stale.PutMessage([]byte{1}))
+	assert.NoError(stale.Flush())
+
+	sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo", Fencing: FencingTakeover})
+	require.NoError(err)
+	assert.NoError(sink.PutMessage([]byte{2}))
+
+	// the stale sink cannot start another batch.
+	assert.Equal(ErrFenced, stale.PutMessage([]byte{3}))
+	assert.NoError(sink.Close())
+
+	next, err := nextSequence(ss, "/foo")
+	assert.NoError(err)
+	assert.Equal(2, next)
+}
+
+func TestFencingFailFastAutoFlush(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	config := MessageSinkAutoFlushConfig{Path: "/foo", Fencing: FencingFailFast}
+	sink, err := NewMessageAutoFlushSink(ss, config)
+	require.NoError(err)
+	assert.NoError(sink.PutMessage([]byte{1}))
+	assert.NoError(sink.Close())
+
+	// the lease was released on close.
+	sink, err = NewMessageAutoFlushSink(ss, config)
+	require.NoError(err)
+	assert.NoError(sink.Close())
+}
+
+func TestFencedSinkDoesNotSeal(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	stale, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo", Fencing: FencingTakeover})
+	require.NoError(err)
+	f := stale.PutMessageAsync([]byte{1})
+	// requests are handled in order, so both messages have been written
+	// once this returns.
+	assert.NoError(stale.PutMessage([]byte{2}))
+
+	// the new sink seals the batch the stale sink is still writing.
+	sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo", Fencing: FencingTakeover, Recovery: RecoverySeal})
+	require.NoError(err)
+	assert.NoError(sink.PutMessage([]byte{3}))
+	assert.NoError(sink.Close())
+
+	// the stale sink does not seal it again, or acknowledge its messages.
+	assert.Equal(ErrFenced, stale.Flush())
+	assert.Equal(ErrFenced, f.Wait())
+
+	source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", StopAtEnd: true})
+	got, err := consumeAll(context.Background(), source)
+	assert.NoError(err)
+	assert.Equal([][]byte{{1}, {2}, {3}}, got)
+}
@@ -0,0 +1,86 @@
+package freezer
+
+import (
+	"context"
+	"io"
+
+	"github.com/uw-labs/straw"
+)
+
+// prefetcher reads upcoming batch files into memory in the background. At most
+// n batches are held at any time: n-1 waiting in the channel and one being
+// read. Only batches followed by another are read, as the last batch may still
+// be being written.
+type prefetcher struct {
+	batches chan prefetchedBatch
+	stop    chan struct{}
+}
+
+type prefetchedBatch struct {
+	seq  int
+	data []byte
+	// size is the size of the batch file, as stored, before it was read.
+	size int64
+}
+
+// newPrefetcher starts prefetching batches from the stream at basepath, which
+// are read from ss, and whose sizes are found in store.
+func newPrefetcher(store, ss straw.StreamStore, basepath string, from int, n int) *prefetcher {
+	p := &prefetcher{
+		batches: make(chan prefetchedBatch, n-1),
+		stop:    make(chan struct{}),
+	}
+	go p.run(store, ss, basepath, from)
+	return p
+}
+
+func (p *prefetcher) run(store, ss straw.StreamStore, basepath string, from int) {
+	defer close(p.batches)
+	for seq := from; ; seq++ {
+		// the reader opens batches that can't be prefetched itself, and
+		// then starts prefetching again.
+		if _, err := store.Stat(seqToPath(basepath, seq+1)); err != nil {
+			return
+		}
+		fi, err := store.Stat(seqToPath(basepath, seq))
+		if err != nil {
+			return
+		}
+		data, err := readBatch(ss, seqToPath(basepath, seq))
+		if err != nil {
+			return
+		}
+		select {
+		case p.batches <- prefetchedBatch{seq, data, fi.Size()}:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// next returns the prefetched batch with the given sequence number, or false
+// if it is not available. It returns ctx's error if ctx is done before the
+// batch has been read.
+func (p *prefetcher) next(ctx context.Context, seq int) (prefetchedBatch, bool, error) {
+	select {
+	case b, ok := <-p.batches:
+		return b, ok && b.seq == seq, nil
+	case <-ctx.Done():
+		return prefetchedBatch{}, false, ctx.Err()
+	}
+}
+
+// close stops prefetching. It does not wait for a batch that is being read,
+// which is dropped once it has been.
+func (p *prefetcher) close() {
+	close(p.stop)
+}
+
+func readBatch(ss straw.StreamStore, path string) ([]byte, error) {
+	rc, err := ss.OpenReadCloser(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
@@ -0,0 +1,190 @@
+package freezer
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+)
+
+func TestPrefetch(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	mem, _ := straw.Open("mem://")
+	ss := &lockedStore{StreamStore: mem}
+
+	sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo", CompressionType: CompressionTypeSnappy})
+	require.NoError(err)
+	for b := byte(0); b < 5; b++ {
+		assert.NoError(sink.PutMessage([]byte{b}))
+		assert.NoError(sink.Flush())
+	}
+	// the last batch is not prefetched, as it may still be being written,
+	// so it is read from the store until it is complete.
+	assert.NoError(sink.PutMessage([]byte{5}))
+	assert.NoError(sink.PutMessage([]byte{6}))
+
+	source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", PollPeriod: 10 * time.Millisecond, CompressionType: CompressionTypeSnappy, Prefetch: 2})
+	r, err := source.NewReader()
+	require.NoError(err)
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*1)
+	defer cancel()
+
+	for b := byte(0); b < 5; b++ {
+		m, err := r.Next(ctx)
+		require.NoError(err)
+		assert.Equal([]byte{b}, m.Data)
+	}
+
+	received := make(chan []byte)
+	go func() {
+		m, err := r.Next(ctx)
+		assert.NoError(err)
+		received <- m.Data
+	}()
+	assert.NoError(sink.Close())
+	assert.Equal([]byte{5}, <-received)
+
+	m, err := r.Next(ctx)
+	require.NoError(err)
+	assert.Equal([]byte{6}, m.Data)
+}
+
+func TestPrefetchContext(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	mem, _ := straw.Open("mem://")
+	sink, err := NewMessageSink(mem, MessageSinkConfig{Path: "/foo"})
+	require.NoError(err)
+	for b := byte(0); b < 3; b++ {
+		assert.NoError(sink.PutMessage([]byte{b}))
+		assert.NoError(sink.Flush())
+	}
+	assert.NoError(sink.Close())
+
+	ss := &blockingStore{StreamStore: mem, path: seqToPath("/foo", 1), release: make(chan struct{})}
+	source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", PollPeriod: 10 * time.Millisecond, Prefetch: 2})
+	r, err := source.NewReader()
+	require.NoError(err)
+	defer r.Close()
+
+	m, err := r.Next(context.Background())
+	require.NoError(err)
+	assert.Equal([]byte{0}, m.Data)
+
+	// a slow prefetch does not hold up the reader past its deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	_, err = r.Next(ctx)
+	assert.Equal(context.DeadlineExceeded, err)
+
+	close(ss.release)
+	m, err = r.Next(context.Background())
+	require.NoError(err)
+	assert.Equal([]byte{1}, m.Data)
+}
+
+func TestPrefetchClose(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	mem, _ := straw.Open("mem://")
+	sink, err := NewMessageSink(mem, MessageSinkConfig{Path: "/foo"})
+	require.NoError(err)
+	for b := byte(0); b < 3; b++ {
+		assert.NoError(sink.PutMessage([]byte{b}))
+		assert.NoError(sink.Flush())
+	}
+	assert.NoError(sink.Close())
+
+	ss := &blockingStore{StreamStore: mem, path: seqToPath("/foo", 1), release: make(chan struct{})}
+	defer close(ss.release)
+	source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", PollPeriod: 10 * time.Millisecond, Prefetch: 2})
+
+	// consumption stops at its deadline, without waiting for the blocked
+	// prefetch of the next batch.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	got, err := consumeAll(ctx, source)
+	assert.NoError(err)
+	assert.Equal([][]byte{{0}}, got)
+	assert.Less(time.Since(start), time.Second)
+}
+
+// blockingStore blocks opening the file at path until release is closed.
+type blockingStore struct {
+	straw.StreamStore
+	path    string
+	release chan struct{}
+}
+
+func (fs *blockingStore) OpenReadCloser(name string) (straw.StrawReader, error) {
+	if name == fs.path {
+		<-fs.release
+	}
+	return fs.StreamStore.OpenReadCloser(name)
+}
+
+// lockedStore serialises access to a mem store, which does not support
+// reading files while they are written.
+type lockedStore struct {
+	straw.StreamStore
+	mu sync.Mutex
+}
+
+func (fs *lockedStore) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fi, err := fs.StreamStore.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	// mem stores return the file itself, so its size must be read here.
+	return sizedFileInfo{fi, fi.Size()}, nil
+}
+
+type sizedFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi sizedFileInfo) Size() int64 {
+	return fi.size
+}
+
+func (fs *lockedStore) OpenReadCloser(name string) (straw.StrawReader, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.StreamStore.OpenReadCloser(name)
+}
+
+func (fs *lockedStore) CreateWriteCloser(name string) (straw.StrawWriter, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	wc, err := fs.StreamStore.CreateWriteCloser(name)
+	if err != nil {
+		return nil, err
+	}
+	return &lockedWriter{wc, fs}, nil
+}
+
+type lockedWriter struct {
+	straw.StrawWriter
+	fs *lockedStore
+}
+
+func (w *lockedWriter) Write(buf []byte) (int, error) {
+	w.fs.mu.Lock()
+	defer w.fs.mu.Unlock()
+	return w.StrawWriter.Write(buf)
+}
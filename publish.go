@@ -0,0 +1,114 @@
+package freezer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/uw-labs/straw"
+)
+
+// Renamer is implemented by stores that can rename files. Sinks with
+// AtomicPublish set use it to publish batches, if their store implements it.
+// Rename must replace newpath atomically if it exists.
+type Renamer interface {
+	Rename(oldpath, newpath string) error
+}
+
+// NewOSStreamStore returns straw's local filesystem store, as opened with a
+// file:// URL, with a Rename method, so that sinks using it publish batches
+// atomically.
+func NewOSStreamStore() (straw.StreamStore, error) {
+	ss, err := straw.Open("file:///")
+	if err != nil {
+		return nil, err
+	}
+	return osStreamStore{ss}, nil
+}
+
+type osStreamStore struct {
+	straw.StreamStore
+}
+
+func (osStreamStore) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+const tempDir = ".tmp"
+
+func tempPath(basepath string, seq int) string {
+	return filepath.Join(basepath, tempDir, fmt.Sprintf("%014d", seq))
+}
+
+// batchPath returns the path that the batch with the given sequence number is
+// written to while it is being written.
+func (mq *MessageSink) batchPath(seq int) string {
+	if mq.atomicPublish {
+		return tempPath(mq.path, seq)
+	}
+	return seqToPath(mq.path, seq)
+}
+
+// publish makes a sealed batch visible at its final path, if it was written
+// elsewhere.
+func (mq *MessageSink) publish(seq int) error {
+	if !mq.atomicPublish {
+		return nil
+	}
+	return mq.moveBatch(tempPath(mq.path, seq), seq)
+}
+
+// moveBatch moves the batch file at from to the path of the batch with the
+// given sequence number. Stores that do not implement Renamer have the batch
+// copied instead, which is not atomic on filesystems, and on object stores
+// means writing the batch a second time.
+func (mq *MessageSink) moveBatch(from string, seq int) error {
+	to := seqToPath(mq.path, seq)
+	if err := straw.MkdirAll(mq.store, filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	if r, ok := mq.store.(Renamer); ok {
+		return r.Rename(from, to)
+	}
+	if err := copyFile(mq.store, from, to); err != nil {
+		return err
+	}
+	return mq.store.Remove(from)
+}
+
+// publishTempBatches deals with batches left at temporary paths by a previous
+// sink, which either failed to publish them after sealing them, or failed
+// before sealing them. Sealed batches are published, as their messages may
+// have been acknowledged, while unsealed ones are removed, as their messages
+// cannot have been.
+func (mq *MessageSink) publishTempBatches() error {
+	dir := filepath.Join(mq.path, tempDir)
+	fis, err := mq.store.Readdir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, fi := range fis {
+		name := filepath.Join(dir, fi.Name())
+		seq, err := strconv.Atoi(fi.Name())
+		if err != nil {
+			return fmt.Errorf("unexpected file %v", name)
+		}
+		complete, err := scanBatch(mq.streamstore, name, nil)
+		if err != nil {
+			return fmt.Errorf("could not read temporary batch %v (%v)", name, err)
+		}
+		if complete {
+			err = mq.moveBatch(name, seq)
+		} else {
+			err = mq.store.Remove(name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
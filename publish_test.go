@@ -0,0 +1,133 @@
+package freezer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+)
+
+func TestAtomicPublish(t *testing.T) {
+	mem, _ := straw.Open("mem://")
+	renaming := &renamingStore{StreamStore: mem}
+
+	tests := []struct {
+		name    string
+		ss      straw.StreamStore
+		renames int
+	}{
+		{"Copy", mem, 0},
+		{"Rename", renaming, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			path := "/" + test.name
+
+			sink, err := NewMessageSink(test.ss, MessageSinkConfig{Path: path, AtomicPublish: true})
+			require.NoError(err)
+			assert.NoError(sink.PutMessage([]byte{1}))
+
+			_, err = test.ss.Stat(seqToPath(path, 0))
+			assert.True(os.IsNotExist(err))
+			_, err = test.ss.Stat(tempPath(path, 0))
+			assert.NoError(err)
+
+			assert.NoError(sink.Flush())
+			assert.NoError(sink.PutMessage([]byte{2}))
+			assert.NoError(sink.Close())
+
+			_, err = test.ss.Stat(tempPath(path, 0))
+			assert.True(os.IsNotExist(err))
+
+			source := NewMessageSource(test.ss, MessageSourceConfig{Path: path, StopAtEnd: true})
+
+			got, err := consumeAll(context.Background(), source)
+			assert.NoError(err)
+			assert.Equal([][]byte{{1}, {2}}, got)
+			assert.Equal(test.renames, renaming.renames)
+		})
+	}
+}
+
+func TestAtomicPublishRemovesUnsealedBatches(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo", AtomicPublish: true})
+	require.NoError(err)
+	assert.NoError(sink.PutMessage([]byte{1}))
+
+	// a new sink finds the unsealed batch of the previous one.
+	sink, err = NewMessageSink(ss, MessageSinkConfig{Path: "/foo", AtomicPublish: true})
+	require.NoError(err)
+	assert.NoError(sink.Close())
+
+	_, err = ss.Stat(tempPath("/foo", 0))
+	assert.True(os.IsNotExist(err))
+}
+
+func TestAtomicPublishPublishesSealedBatches(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ss, _ := straw.Open("mem://")
+
+	// a previous sink sealed this batch but failed to publish it.
+	writeFile(t, ss, tempPath("/foo", 0), append(append(length(1), 1), delim...))
+
+	sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo", AtomicPublish: true})
+	require.NoError(err)
+	assert.NoError(sink.PutMessage([]byte{2}))
+	assert.NoError(sink.Close())
+
+	source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", StopAtEnd: true})
+	got, err := consumeAll(context.Background(), source)
+	assert.NoError(err)
+	assert.Equal([][]byte{{1}, {2}}, got)
+}
+
+func TestOSStreamStoreRename(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ss, err := NewOSStreamStore()
+	require.NoError(err)
+	path := t.TempDir()
+
+	sink, err := NewMessageSink(ss, MessageSinkConfig{Path: path, AtomicPublish: true})
+	require.NoError(err)
+	assert.NoError(sink.PutMessage([]byte{1}))
+	assert.NoError(sink.Close())
+
+	fis, err := ss.Readdir(filepath.Join(path, tempDir))
+	assert.NoError(err)
+	assert.Empty(fis)
+
+	source := NewMessageSource(ss, MessageSourceConfig{Path: path, StopAtEnd: true})
+	got, err := consumeAll(context.Background(), source)
+	assert.NoError(err)
+	assert.Equal([][]byte{{1}}, got)
+}
+
+// renamingStore adds a (non-atomic) Rename to a store.
+type renamingStore struct {
+	straw.StreamStore
+	renames int
+}
+
+func (fs *renamingStore) Rename(oldpath, newpath string) error {
+	fs.renames++
+	if err := copyFile(fs.StreamStore, oldpath, newpath); err != nil {
+		return err
+	}
+	return fs.StreamStore.Remove(oldpath)
+}
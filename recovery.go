@@ -0,0 +1,133 @@
+package freezer
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/uw-labs/straw"
+)
+
+// RecoveryPolicy determines what a new sink does with the last batch of a
+// stream if it has no end marker. Consumers would otherwise wait on such a
+// batch forever. A batch that cannot be read, because it is corrupt, or is
+// compressed and ends part way through a compressed block, is quarantined
+// whatever the policy, as quarantining loses nothing.
+type RecoveryPolicy int
+
+const (
+	// RecoveryNone leaves the batch as it is.
+	RecoveryNone RecoveryPolicy = 0
+	// RecoverySeal rewrites the batch with its complete messages followed
+	// by the end marker. Any partially written message is dropped. The
+	// messages of the batch were never signed, so if the sink has a Signer
+	// the batch is quarantined instead, rather than signed unchecked.
+	RecoverySeal RecoveryPolicy = 1
+	// RecoveryQuarantine copies the batch, as stored, into the quarantine
+	// directory of the stream and replaces it with an empty batch.
+	RecoveryQuarantine RecoveryPolicy = 2
+)
+
+const quarantineDir = ".quarantine"
+
+func quarantinePath(basepath string, seq int) string {
+	return filepath.Join(basepath, quarantineDir, fmt.Sprintf("%014d", seq))
+}
+
+// recoverBatch checks that the batch with the given sequence number is
+// terminated, and applies the recovery policy if not. The complete messages
+// of the batch are held in memory while it is rewritten. The new batch is
+// written to a temporary path and then moved over the old one, so the old one
+// is left in place if the sink fails while writing it.
+func (mq *MessageSink) recoverBatch(seq int, policy RecoveryPolicy) error {
+	if policy == RecoveryNone {
+		return nil
+	}
+
+	fullname := seqToPath(mq.path, seq)
+
+	var messages [][]byte
+	complete, err := scanBatch(mq.streamstore, fullname, func(m []byte) error {
+		messages = append(messages, m)
+		return nil
+	})
+	if complete {
+		return nil
+	}
+
+	quarantine := err != nil
+	switch policy {
+	case RecoverySeal:
+		quarantine = quarantine || mq.signer != nil
+	case RecoveryQuarantine:
+		quarantine = true
+	default:
+		return fmt.Errorf("unknown recovery policy %d", policy)
+	}
+	if quarantine {
+		if err := copyFile(mq.store, fullname, quarantinePath(mq.path, seq)); err != nil {
+			return err
+		}
+		messages = nil
+	}
+
+	temp := tempPath(mq.path, seq)
+	if err := straw.MkdirAll(mq.store, filepath.Dir(temp), 0755); err != nil {
+		return err
+	}
+	wc, err := mq.streamstore.CreateWriteCloser(temp)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = wc
+	digest := sha256.New()
+	if mq.signer != nil {
+		w = io.MultiWriter(wc, digest)
+	}
+	if err := writeFormatHeader(w, mq.flags); err != nil {
+		_ = wc.Close()
+		return err
+	}
+	for _, m := range messages {
+		if err := writeRecord(w, mq.flags, m); err != nil {
+			_ = wc.Close()
+			return err
+		}
+	}
+	if _, err := w.Write(endMarker); err != nil {
+		_ = wc.Close()
+		return err
+	}
+	if mq.signer != nil {
+		if err := writeSignature(wc, mq.signer, mq.path, seq, digest); err != nil {
+			_ = wc.Close()
+			return err
+		}
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+	return mq.moveBatch(temp, seq)
+}
+
+func copyFile(ss straw.StreamStore, from, to string) error {
+	rc, err := ss.OpenReadCloser(from)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if err := straw.MkdirAll(ss, filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	wc, err := ss.CreateWriteCloser(to)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(wc, rc); err != nil {
+		_ = wc.Close()
+		return err
+	}
+	return wc.Close()
+}
@@ -0,0 +1,152 @@
+package freezer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+)
+
+func TestSinkRecovery(t *testing.T) {
+	truncated := append(append(append(length(1), 1), append(length(1), 2)...), append(length(10), 3, 3, 3)...)
+
+	tests := []struct {
+		name       string
+		policy     RecoveryPolicy
+		expected   [][]byte
+		quarantine bool
+	}{
+		{"Seal", RecoverySeal, [][]byte{{1}, {2}, {4}}, false},
+		{"Quarantine", RecoveryQuarantine, [][]byte{{4}}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			ss, _ := straw.Open("mem://")
+			writeFile(t, ss, seqToPath("/foo", 0), truncated)
+
+			sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo", Recovery: test.policy})
+			require.NoError(err)
+			assert.NoError(sink.PutMessage([]byte{4}))
+			assert.NoError(sink.Close())
+
+			source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", StopAtEnd: true})
+
+			got, err := consumeAll(context.Background(), source)
+			assert.NoError(err)
+			assert.Equal(test.expected, got)
+
+			_, err = ss.Stat(tempPath("/foo", 0))
+			assert.True(os.IsNotExist(err))
+
+			rc, err := ss.OpenReadCloser(quarantinePath("/foo", 0))
+			if !test.quarantine {
+				assert.Error(err)
+				return
+			}
+			require.NoError(err)
+			defer rc.Close()
+			data, err := io.ReadAll(rc)
+			assert.NoError(err)
+			assert.Equal(truncated, data)
+		})
+	}
+}
+
+func TestSinkRecoveryLeavesBatch(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	truncated := append(length(1), 1, 0, 0)
+
+	ss, _ := straw.Open("mem://")
+	writeFile(t, ss, seqToPath("/foo", 0), truncated)
+
+	sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo"})
+	require.NoError(err)
+	assert.NoError(sink.Close())
+
+	rc, err := ss.OpenReadCloser(seqToPath("/foo", 0))
+	require.NoError(err)
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	assert.NoError(err)
+	assert.Equal(truncated, data)
+}
+
+func TestSinkRecoveryQuarantinesUnreadableBatch(t *testing.T) {
+	// a snappy stream that ends part way through its second block, which
+	// snappy reports as corrupt.
+	var buf bytes.Buffer
+	w := snappy.NewBufferedWriter(&buf)
+	assert.NoError(t, writeRecord(w, 0, []byte{1}))
+	assert.NoError(t, w.Flush())
+	assert.NoError(t, writeRecord(w, 0, []byte{2}))
+	assert.NoError(t, w.Close())
+	midBlock := append([]byte{}, buf.Bytes()[:buf.Len()-2]...)
+
+	// a snappy stream with a corrupt block checksum.
+	corrupt := append([]byte{}, buf.Bytes()...)
+	corrupt[len(corrupt)-1] ^= 1
+
+	tests := []struct {
+		name   string
+		policy RecoveryPolicy
+		data   []byte
+	}{
+		{"Seal", RecoverySeal, midBlock},
+		{"Quarantine", RecoveryQuarantine, midBlock},
+		{"Corrupt", RecoverySeal, corrupt},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			ss, _ := straw.Open("mem://")
+			writeFile(t, ss, seqToPath("/foo", 0), test.data)
+
+			sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo", CompressionType: CompressionTypeSnappy, Recovery: test.policy})
+			require.NoError(err)
+			assert.NoError(sink.PutMessage([]byte{3}))
+			assert.NoError(sink.Close())
+
+			source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", CompressionType: CompressionTypeSnappy, StopAtEnd: true})
+			got, err := consumeAll(context.Background(), source)
+			assert.NoError(err)
+			assert.Equal([][]byte{{3}}, got)
+
+			rc, err := ss.OpenReadCloser(quarantinePath("/foo", 0))
+			require.NoError(err)
+			defer rc.Close()
+			data, err := io.ReadAll(rc)
+			assert.NoError(err)
+			assert.Equal(test.data, data)
+		})
+	}
+}
+
+func writeFile(t *testing.T, ss straw.StreamStore, path string, data []byte) {
+	if err := straw.MkdirAll(ss, filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	wc, err := ss.CreateWriteCloser(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wc.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := wc.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,196 @@
+package freezer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/uw-labs/straw"
+)
+
+// RetentionConfig configures which batches of a stream Retention removes.
+// Batches are only ever removed from the start of the stream, oldest first,
+// and the last batch is always kept, since a sink may still be writing it.
+type RetentionConfig struct {
+	Path string
+
+	// MaxAge, if set, removes batches last modified longer ago than this.
+	MaxAge time.Duration
+	// MaxCount, if set, is the number of batches to keep.
+	MaxCount int
+	// MaxBytes, if set, is the total stored size of the batches to keep.
+	MaxBytes int64
+
+	// Interval is how often Run prunes the stream. The default is
+	// DefaultRetentionInterval.
+	Interval time.Duration
+}
+
+const DefaultRetentionInterval = time.Hour
+
+// Retention removes old batches from a stream.
+type Retention struct {
+	store    straw.StreamStore
+	path     string
+	maxAge   time.Duration
+	maxCount int
+	maxBytes int64
+	interval time.Duration
+}
+
+func NewRetention(streamstore straw.StreamStore, config RetentionConfig) *Retention {
+	r := &Retention{
+		store:    streamstore,
+		path:     config.Path,
+		maxAge:   config.MaxAge,
+		maxCount: config.MaxCount,
+		maxBytes: config.MaxBytes,
+		interval: config.Interval,
+	}
+	if r.interval == 0 {
+		r.interval = DefaultRetentionInterval
+	}
+	return r
+}
+
+// Run prunes the stream every Interval until ctx is done.
+func (r *Retention) Run(ctx context.Context) error {
+	t := time.NewTicker(r.interval)
+	defer t.Stop()
+	for {
+		if _, err := r.Prune(); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// batchFile is a batch found in a stream.
+type batchFile struct {
+	seq int
+	fi  os.FileInfo
+}
+
+// Prune removes the batches that are beyond the retention limits, along with
+// any directories left empty, and returns the number of batches removed.
+func (r *Retention) Prune() (int, error) {
+	batches, err := listBatches(r.store, r.path)
+	if err != nil {
+		return 0, err
+	}
+	n := r.prunable(batches, time.Now())
+	if n == 0 {
+		return 0, nil
+	}
+	// the low watermark is recorded first, so that sources never find a
+	// batch missing without it.
+	if err := writeLowWatermark(r.store, r.path, batches[n].seq); err != nil {
+		return 0, err
+	}
+	for i, b := range batches[:n] {
+		if err := r.remove(b.seq); err != nil {
+			return i, err
+		}
+	}
+	return n, nil
+}
+
+// prunable returns the number of batches, from the start of batches, that are
+// beyond the retention limits.
+func (r *Retention) prunable(batches []batchFile, now time.Time) int {
+	n := 0
+	if r.maxCount > 0 && len(batches)-r.maxCount > n {
+		n = len(batches) - r.maxCount
+	}
+	if r.maxBytes > 0 {
+		var total int64
+		for _, b := range batches {
+			total += b.fi.Size()
+		}
+		i := 0
+		for ; total > r.maxBytes && i < len(batches); i++ {
+			total -= batches[i].fi.Size()
+		}
+		if i > n {
+			n = i
+		}
+	}
+	if r.maxAge > 0 {
+		i := 0
+		for i < len(batches) && now.Sub(batches[i].fi.ModTime()) > r.maxAge {
+			i++
+		}
+		if i > n {
+			n = i
+		}
+	}
+	if n > len(batches)-1 {
+		n = len(batches) - 1
+	}
+	if n < 0 {
+		n = 0
+	}
+	return n
+}
+
+// remove removes a batch, then the directories above it that are left empty.
+func (r *Retention) remove(seq int) error {
+	name := seqToPath(r.path, seq)
+	if err := r.store.Remove(name); err != nil {
+		return err
+	}
+	for i := 0; i < dirDepth; i++ {
+		name = filepath.Dir(name)
+		fis, err := r.store.Readdir(name)
+		if err != nil {
+			return err
+		}
+		if len(fis) != 0 {
+			return nil
+		}
+		if err := r.store.Remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listBatches returns the batches of a stream in sequence order.
+func listBatches(ss straw.StreamStore, basedir string) ([]batchFile, error) {
+	var batches []batchFile
+	var walk func(dir string, depth, prefix int) error
+	walk = func(dir string, depth, prefix int) error {
+		fis, err := readdirVisible(ss, dir)
+		if err != nil {
+			return err
+		}
+		for _, fi := range fis {
+			num, err := strconv.Atoi(fi.Name())
+			if err != nil {
+				return err
+			}
+			seq := prefix*100 + num
+			if depth < dirDepth {
+				if err := walk(filepath.Join(dir, fi.Name()), depth+1, seq); err != nil {
+					return err
+				}
+				continue
+			}
+			batches = append(batches, batchFile{seq, fi})
+		}
+		return nil
+	}
+	if err := walk(basedir, 0, 0); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return batches, nil
+}
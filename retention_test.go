@@ -0,0 +1,93 @@
+package freezer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+)
+
+// writeBatches writes n batches of one message each to the stream at path.
+func writeBatches(t *testing.T, ss straw.StreamStore, path string, n int) {
+	sink, err := NewMessageSink(ss, MessageSinkConfig{Path: path})
+	require.NoError(t, err)
+	for i := 0; i < n; i++ {
+		require.NoError(t, sink.PutMessage([]byte{byte(i)}))
+		require.NoError(t, sink.Flush())
+	}
+	require.NoError(t, sink.Close())
+}
+
+func batchSeqs(t *testing.T, ss straw.StreamStore, path string) []int {
+	batches, err := listBatches(ss, path)
+	require.NoError(t, err)
+	var seqs []int
+	for _, b := range batches {
+		seqs = append(seqs, b.seq)
+	}
+	return seqs
+}
+
+func TestRetention(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  RetentionConfig
+		removed int
+		kept    []int
+	}{
+		{"None", RetentionConfig{}, 0, []int{0, 1, 2, 3, 4}},
+		{"MaxCount", RetentionConfig{MaxCount: 2}, 3, []int{3, 4}},
+		// each batch is 9 bytes.
+		{"MaxBytes", RetentionConfig{MaxBytes: 20}, 3, []int{3, 4}},
+		// mem store files have no modification time, so are all old.
+		{"MaxAge", RetentionConfig{MaxAge: time.Hour}, 4, []int{4}},
+		{"KeepsLast", RetentionConfig{MaxBytes: 1}, 4, []int{4}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			ss, _ := straw.Open("mem://")
+			writeBatches(t, ss, "/foo", 5)
+
+			test.config.Path = "/foo"
+			removed, err := NewRetention(ss, test.config).Prune()
+			assert.NoError(err)
+			assert.Equal(test.removed, removed)
+			assert.Equal(test.kept, batchSeqs(t, ss, "/foo"))
+
+			wm, err := LowWatermark(ss, "/foo")
+			assert.NoError(err)
+			assert.Equal(test.kept[0], wm)
+
+			next, err := nextSequence(ss, "/foo")
+			assert.NoError(err)
+			assert.Equal(5, next)
+		})
+	}
+}
+
+func TestRetentionRemovesEmptyDirs(t *testing.T) {
+	assert := assert.New(t)
+
+	ss, _ := straw.Open("mem://")
+	for _, seq := range []int{98, 99, 100, 10000} {
+		writeFile(t, ss, seqToPath("/foo", seq), endMarker)
+	}
+
+	removed, err := NewRetention(ss, RetentionConfig{Path: "/foo", MaxCount: 1}).Prune()
+	assert.NoError(err)
+	assert.Equal(3, removed)
+	assert.Equal([]int{10000}, batchSeqs(t, ss, "/foo"))
+
+	_, err = ss.Stat(filepath.Dir(seqToPath("/foo", 0)))
+	assert.True(os.IsNotExist(err))
+	_, err = ss.Stat(filepath.Dir(filepath.Dir(seqToPath("/foo", 0))))
+	assert.True(os.IsNotExist(err))
+	_, err = ss.Stat(filepath.Dir(seqToPath("/foo", 10000)))
+	assert.NoError(err)
+}
@@ -0,0 +1,223 @@
+package freezer
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"path/filepath"
+)
+
+// A signed batch has flagSigned set, and is followed after its end marker by
+// a signature trailer: the length of the key ID as a byte, the key ID, the
+// length of the signature as 2 little endian bytes, and the signature. The
+// signature covers the digest of the batch, which is the SHA-256 of the
+// length of the stream path as 4 big endian bytes, the cleaned stream path,
+// the batch's sequence number as 8 big endian bytes, and the SHA-256 of the
+// uncompressed batch up to and including its end marker. Including the stream
+// path and sequence number means that batches cannot be swapped around, or
+// copied between streams, undetected, but also that a signed stream must be
+// read from the path it was written to.
+
+// Signer signs batches written by a sink.
+type Signer interface {
+	// Sign returns the signature of a batch digest, and the ID of the key
+	// that made it.
+	Sign(digest []byte) (string, []byte, error)
+}
+
+// Verifier verifies the signatures of batches read by a source.
+type Verifier interface {
+	// Verify returns an error unless sig is a valid signature of digest
+	// made by the key with the given ID.
+	Verify(keyID string, digest, sig []byte) error
+}
+
+// SignatureError is returned when a batch read by a source with a Verifier is
+// unsigned, or its signature is not valid.
+type SignatureError struct {
+	Sequence int
+	Path     string
+	Err      error
+}
+
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("batch %v failed signature verification (%v)", e.Path, e.Err)
+}
+
+func (e *SignatureError) Unwrap() error {
+	return e.Err
+}
+
+// HMACSigner signs batches with HMAC-SHA256.
+type HMACSigner struct {
+	KeyID string
+	Key   []byte
+}
+
+func (s HMACSigner) Sign(digest []byte) (string, []byte, error) {
+	mac := hmac.New(sha256.New, s.Key)
+	mac.Write(digest)
+	return s.KeyID, mac.Sum(nil), nil
+}
+
+// HMACVerifier verifies batches signed by an HMACSigner with any of its keys.
+type HMACVerifier struct {
+	// Keys are the available keys, by ID.
+	Keys map[string][]byte
+}
+
+func (v HMACVerifier) Verify(keyID string, digest, sig []byte) error {
+	key, ok := v.Keys[keyID]
+	if !ok {
+		return fmt.Errorf("unknown key %q", keyID)
+	}
+	_, expected, _ := HMACSigner{keyID, key}.Sign(digest)
+	if !hmac.Equal(sig, expected) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// Ed25519Signer signs batches with an ed25519 private key.
+type Ed25519Signer struct {
+	KeyID string
+	Key   ed25519.PrivateKey
+}
+
+func (s Ed25519Signer) Sign(digest []byte) (string, []byte, error) {
+	return s.KeyID, ed25519.Sign(s.Key, digest), nil
+}
+
+// Ed25519Verifier verifies batches signed by an Ed25519Signer whose public key
+// it holds.
+type Ed25519Verifier struct {
+	// Keys are the available public keys, by ID.
+	Keys map[string]ed25519.PublicKey
+}
+
+func (v Ed25519Verifier) Verify(keyID string, digest, sig []byte) error {
+	key, ok := v.Keys[keyID]
+	if !ok {
+		return fmt.Errorf("unknown key %q", keyID)
+	}
+	if !ed25519.Verify(key, digest, sig) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+func batchDigest(stream string, seq int, contentHash []byte) []byte {
+	stream = filepath.Clean(stream)
+	h := sha256.New()
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(stream)))
+	h.Write(l[:])
+	h.Write([]byte(stream))
+	var s [8]byte
+	binary.BigEndian.PutUint64(s[:], uint64(seq))
+	h.Write(s[:])
+	h.Write(contentHash)
+	return h.Sum(nil)
+}
+
+// writeSignature writes the signature trailer of the batch of stream with the
+// given sequence number, whose content up to and including its end marker has
+// been written to content.
+func writeSignature(w io.Writer, s Signer, stream string, seq int, content hash.Hash) error {
+	keyID, sig, err := s.Sign(batchDigest(stream, seq, content.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	if len(keyID) > 255 || len(sig) > 65535 {
+		return errors.New("signature is too long")
+	}
+	trailer := []byte{byte(len(keyID))}
+	trailer = append(trailer, keyID...)
+	var l [2]byte
+	binary.LittleEndian.PutUint16(l[:], uint16(len(sig)))
+	trailer = append(trailer, l[:]...)
+	trailer = append(trailer, sig...)
+	_, err = w.Write(trailer)
+	return err
+}
+
+// readSignature reads the signature trailer that follows the end marker of a
+// signed batch, which is at the start of buf.
+func (rr *recordReader) readSignature() error {
+	n := len(endMarker)
+	if err := rr.fill(n + 1); err != nil {
+		return rr.signatureError(err)
+	}
+	keyID := n + 1
+	sigLen := keyID + int(rr.buf[n])
+	if err := rr.fill(sigLen + 2); err != nil {
+		return rr.signatureError(err)
+	}
+	sig := sigLen + 2
+	end := sig + int(binary.LittleEndian.Uint16(rr.buf[sigLen:]))
+	if err := rr.fill(end); err != nil {
+		return rr.signatureError(err)
+	}
+	rr.keyID = string(rr.buf[keyID:sigLen])
+	rr.signature = rr.buf[sig:end]
+	rr.signed = rr.offset + int64(n)
+	return nil
+}
+
+func (rr *recordReader) signatureError(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("Could not read signature from %v (%w)", rr.path, err)
+}
+
+// batchVerifier checks the signature of a batch as it is read. Each part of
+// the batch is scanned once, as it arrives, and the signature is checked once
+// the end marker and signature trailer have arrived.
+type batchVerifier struct {
+	v      Verifier
+	stream string
+	seq    int
+	path   string
+	rr     *recordReader
+	// data is what has been read of the uncompressed batch.
+	data []byte
+}
+
+func newBatchVerifier(v Verifier, stream string, seq int, path string) *batchVerifier {
+	return &batchVerifier{v: v, stream: stream, seq: seq, path: path, rr: &recordReader{path: path}}
+}
+
+// add adds p, the next data read from the batch, and reports whether the
+// batch is complete, in which case it has been verified. It returns a
+// *SignatureError if the batch is unsigned or its signature is not valid.
+func (bv *batchVerifier) add(p []byte) (bool, error) {
+	bv.data = append(bv.data, p...)
+	bv.rr.r = bytes.NewReader(bv.data[bv.rr.consumed():])
+	for {
+		_, ok, err := bv.rr.next()
+		if err != nil {
+			if isTruncated(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		if !ok {
+			break
+		}
+	}
+	if bv.rr.flags&flagSigned == 0 {
+		return false, &SignatureError{Sequence: bv.seq, Path: bv.path, Err: errors.New("batch is not signed")}
+	}
+	content := sha256.Sum256(bv.data[:bv.rr.signed])
+	if err := bv.v.Verify(bv.rr.keyID, batchDigest(bv.stream, bv.seq, content[:]), bv.rr.signature); err != nil {
+		return false, &SignatureError{Sequence: bv.seq, Path: bv.path, Err: err}
+	}
+	return true, nil
+}
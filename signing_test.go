@@ -0,0 +1,214 @@
+package freezer
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uw-labs/straw"
+)
+
+func TestSignedBatches(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		signer   Signer
+		verifier Verifier
+	}{
+		{"HMAC", HMACSigner{"k1", []byte("secret")}, HMACVerifier{map[string][]byte{"k1": []byte("secret")}}},
+		{"Ed25519", Ed25519Signer{"k1", priv}, Ed25519Verifier{map[string]ed25519.PublicKey{"k1": pub}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			ss, _ := straw.Open("mem://")
+
+			sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo", CompressionType: CompressionTypeSnappy, Checksums: true, Signer: test.signer})
+			require.NoError(err)
+			assert.NoError(sink.PutMessages([][]byte{{1}, {2}}))
+			assert.NoError(sink.Flush())
+			assert.NoError(sink.PutMessage([]byte{3}))
+			assert.NoError(sink.Close())
+
+			source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", CompressionType: CompressionTypeSnappy, StopAtEnd: true, Verifier: test.verifier})
+			got, err := consumeAll(context.Background(), source)
+			assert.NoError(err)
+			assert.Equal([][]byte{{1}, {2}, {3}}, got)
+
+			// sources without a verifier ignore signatures.
+			source = NewMessageSource(ss, MessageSourceConfig{Path: "/foo", CompressionType: CompressionTypeSnappy, StopAtEnd: true})
+			got, err = consumeAll(context.Background(), source)
+			assert.NoError(err)
+			assert.Equal([][]byte{{1}, {2}, {3}}, got)
+		})
+	}
+}
+
+func TestSignatureVerificationFailures(t *testing.T) {
+	signer := HMACSigner{"k1", []byte("secret")}
+	verifier := HMACVerifier{map[string][]byte{"k1": []byte("secret")}}
+
+	tests := []struct {
+		name  string
+		alter func(straw.StreamStore, []byte)
+		err   string
+	}{
+		{"Altered", func(ss straw.StreamStore, batch []byte) {
+			batch[formatHeaderLen+4] ^= 1
+			writeFile(t, ss, seqToPath("/foo", 1), batch)
+		}, "invalid signature"},
+		{"Moved", func(ss straw.StreamStore, batch []byte) {
+			writeFile(t, ss, seqToPath("/foo", 0), batch)
+		}, "invalid signature"},
+		{"Copied", func(ss straw.StreamStore, batch []byte) {
+			// a batch signed with the same key and sequence number, but
+			// for another stream.
+			sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/bar", Signer: signer})
+			require.NoError(t, err)
+			assert.NoError(t, sink.PutMessage([]byte{1, 2, 3}))
+			assert.NoError(t, sink.Flush())
+			assert.NoError(t, sink.PutMessage([]byte{7}))
+			assert.NoError(t, sink.Close())
+			rc, err := ss.OpenReadCloser(seqToPath("/bar", 1))
+			require.NoError(t, err)
+			defer rc.Close()
+			other, err := io.ReadAll(rc)
+			require.NoError(t, err)
+			writeFile(t, ss, seqToPath("/foo", 1), other)
+		}, "invalid signature"},
+		{"Unsigned", func(ss straw.StreamStore, batch []byte) {
+			writeFile(t, ss, seqToPath("/foo", 1), append(append(length(1), 7), delim...))
+		}, "batch is not signed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			ss, _ := straw.Open("mem://")
+			sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo", Signer: signer})
+			require.NoError(err)
+			assert.NoError(sink.PutMessage([]byte{1, 2, 3}))
+			assert.NoError(sink.Flush())
+			assert.NoError(sink.PutMessage([]byte{4, 5, 6}))
+			assert.NoError(sink.Close())
+
+			rc, err := ss.OpenReadCloser(seqToPath("/foo", 1))
+			require.NoError(err)
+			batch, err := io.ReadAll(rc)
+			require.NoError(err)
+			rc.Close()
+			test.alter(ss, batch)
+
+			source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", StopAtEnd: true, Verifier: verifier})
+			_, err = consumeAll(context.Background(), source)
+			var se *SignatureError
+			require.True(errors.As(err, &se), "unexpected error %v", err)
+			assert.EqualError(se.Err, test.err)
+		})
+	}
+}
+
+func TestRecoveryQuarantinesUnsignedBatch(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	signer := HMACSigner{"k1", []byte("secret")}
+	verifier := HMACVerifier{map[string][]byte{"k1": []byte("secret")}}
+
+	ss, _ := straw.Open("mem://")
+	batch := append(length(1), 1)
+	writeFile(t, ss, seqToPath("/foo", 0), batch)
+
+	// the messages of the unterminated batch were never signed, so the
+	// sink does not sign them by sealing the batch.
+	sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo", Signer: signer, Recovery: RecoverySeal})
+	require.NoError(err)
+	assert.NoError(sink.PutMessage([]byte{2}))
+	assert.NoError(sink.Close())
+
+	rc, err := ss.OpenReadCloser(quarantinePath("/foo", 0))
+	require.NoError(err)
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	assert.NoError(err)
+	assert.Equal(batch, data)
+
+	source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", StopAtEnd: true, Verifier: verifier})
+	got, err := consumeAll(context.Background(), source)
+	assert.NoError(err)
+	assert.Equal([][]byte{{2}}, got)
+}
+
+func TestBatchVerifierIsIncremental(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	signer := HMACSigner{"k1", []byte("secret")}
+	verifier := HMACVerifier{map[string][]byte{"k1": []byte("secret")}}
+
+	ss, _ := straw.Open("mem://")
+	sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo", Signer: signer, Checksums: true})
+	require.NoError(err)
+	assert.NoError(sink.PutMessages([][]byte{{1, 2, 3}, {4}}))
+	assert.NoError(sink.Close())
+
+	rc, err := ss.OpenReadCloser(seqToPath("/foo", 0))
+	require.NoError(err)
+	batch, err := io.ReadAll(rc)
+	require.NoError(err)
+	rc.Close()
+
+	// the batch is only verified once its signature has arrived in full.
+	bv := newBatchVerifier(verifier, "/foo", 0, seqToPath("/foo", 0))
+	for i := range batch {
+		complete, err := bv.add(batch[i : i+1])
+		require.NoError(err)
+		assert.Equal(i == len(batch)-1, complete, "offset %d", i)
+	}
+	assert.Equal(batch, bv.data)
+}
+
+func TestVerifyBatchBeingWritten(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	signer := HMACSigner{"k1", []byte("secret")}
+	verifier := HMACVerifier{map[string][]byte{"k1": []byte("secret")}}
+
+	ss, _ := straw.Open("mem://")
+	sink, err := NewMessageSink(ss, MessageSinkConfig{Path: "/foo", Signer: signer})
+	require.NoError(err)
+	assert.NoError(sink.PutMessage([]byte{1}))
+
+	source := NewMessageSource(ss, MessageSourceConfig{Path: "/foo", PollPeriod: 5 * time.Millisecond, Verifier: verifier})
+	r, err := source.NewReader()
+	require.NoError(err)
+	defer r.Close()
+
+	// messages are not delivered until the batch has been signed.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	_, err = r.Next(ctx)
+	assert.Equal(context.DeadlineExceeded, err)
+
+	assert.NoError(sink.PutMessage([]byte{2}))
+	assert.NoError(sink.Close())
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, expected := range [][]byte{{1}, {2}} {
+		m, err := r.Next(ctx)
+		require.NoError(err)
+		assert.Equal(expected, m.Data)
+	}
+}
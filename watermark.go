@@ -0,0 +1,92 @@
+package freezer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/uw-labs/straw"
+)
+
+const metaFile = ".meta"
+
+// prunedCheckPeriod is how often a reader waiting for a batch to be written
+// checks whether it has been removed by Retention instead, after checking
+// once when it starts waiting.
+const prunedCheckPeriod = time.Minute
+
+// streamMeta is metadata about a stream, stored in its directory.
+type streamMeta struct {
+	// LowWatermark is the sequence number of the earliest batch that has
+	// not been removed by Retention.
+	LowWatermark int `json:"low_watermark"`
+}
+
+func metaPath(basepath string) string {
+	return filepath.Join(basepath, metaFile)
+}
+
+// LowWatermark returns the sequence number of the earliest batch of the stream
+// at path that has not been removed by Retention. It is zero if no batches
+// have been removed.
+func LowWatermark(streamstore straw.StreamStore, path string) (int, error) {
+	rc, err := streamstore.OpenReadCloser(metaPath(path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return 0, err
+	}
+	var m streamMeta
+	if err := json.Unmarshal(data, &m); err != nil {
+		return 0, err
+	}
+	return m.LowWatermark, nil
+}
+
+func writeLowWatermark(streamstore straw.StreamStore, path string, seq int) error {
+	data, err := json.Marshal(streamMeta{LowWatermark: seq})
+	if err != nil {
+		return err
+	}
+	wc, err := streamstore.CreateWriteCloser(metaPath(path))
+	if err != nil {
+		return err
+	}
+	if _, err := wc.Write(data); err != nil {
+		_ = wc.Close()
+		return err
+	}
+	return wc.Close()
+}
+
+// PrunedBatchPolicy determines what a MessageSource does when the batch it is
+// due to read has been removed by Retention.
+type PrunedBatchPolicy int
+
+const (
+	// PrunedBatchSkip moves on to the earliest batch that remains.
+	PrunedBatchSkip PrunedBatchPolicy = 0
+	// PrunedBatchFail stops consumption with a *PrunedBatchError.
+	PrunedBatchFail PrunedBatchPolicy = 1
+)
+
+// PrunedBatchError is returned when the batch a source is due to read has been
+// removed by Retention.
+type PrunedBatchError struct {
+	Sequence     int
+	LowWatermark int
+}
+
+func (e *PrunedBatchError) Error() string {
+	return fmt.Sprintf("batch %d was removed, the earliest batch is now %d", e.Sequence, e.LowWatermark)
+}